@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ApprovalGate is the `approval` section of the configuration.  It can be
+// written as `approval: true`, or as a mapping to change how long a job may
+// wait.
+type ApprovalGate struct {
+	Enabled bool
+	// Expiry is how long a job waits for approval before it is rejected.
+	// Zero means it waits forever.
+	Expiry Duration
+}
+
+const defaultApprovalExpiry = 24 * time.Hour
+
+func (gate *ApprovalGate) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		*gate = ApprovalGate{Enabled: enabled, Expiry: Duration(defaultApprovalExpiry)}
+		return nil
+	}
+
+	type plainGate ApprovalGate
+	plain := plainGate{Enabled: true, Expiry: Duration(defaultApprovalExpiry)}
+	if err := unmarshal(&plain); err != nil {
+		return err
+	}
+	*gate = ApprovalGate(plain)
+	return nil
+}
+
+// Approval is the state of a job that stopped at its approval gate.
+type Approval struct {
+	// Workspace is the job's checked out source and build directories, which
+	// are kept while it waits.
+	Workspace BuildConfig
+	// Expires is when the job is rejected if nobody approves it, or zero if
+	// it waits forever.
+	Expires time.Time `json:",omitempty"`
+	// Approved is set once the job has been approved, so that it continues
+	// from its deploy section when it runs again.
+	Approved bool `json:",omitempty"`
+}
+
+// errAwaitingApproval ends a job that has stopped at its approval gate.
+var errAwaitingApproval = errors.New("waiting for approval")
+
+// awaitApproval parks the job after its build, keeping its workspace.
+func (d *deployment) awaitApproval() error {
+	approval := &Approval{Workspace: d.build}
+	if expiry := time.Duration(d.config.Approval.Expiry); expiry > 0 {
+		approval.Expires = time.Now().Add(expiry)
+		d.logger.Printf("Build finished, waiting for approval until %s",
+			approval.Expires.Format(DATE_LAYOUT))
+	} else {
+		d.logger.Println("Build finished, waiting for approval")
+	}
+	d.logger.Printf("Run 'integrad approve %d' to deploy, or 'integrad reject %d' to abort.",
+		d.job.Number, d.job.Number)
+	d.job.Approval = approval
+	return errAwaitingApproval
+}
+
+// Approve queues a job that is waiting for approval to run its deploy
+// section.  It runs before other queued jobs of the same priority.
+func (queue *JobQueue) Approve(number int) (job Job, err error) {
+	err = queue.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(queue.name))
+		job, err = awaitingJob(bucket, number)
+		if err != nil {
+			return err
+		}
+
+		job.RecordStep("approval", "approval", job.Updated, nil)
+		job.Approval.Approved = true
+		job.Status = Queued
+		job.Updated = time.Now()
+		buf, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		if number < queue.current {
+			queue.current = number
+		}
+		return bucket.Put(itob(number), buf)
+	})
+	if err == nil {
+		log.Printf("Job %d approved", number)
+		queue.notifyWorker()
+	}
+	return
+}
+
+// Reject cancels a job that is waiting for approval, without running its
+// hooks.  Its workspace has to be removed with RemoveWorkspace.
+func (queue *JobQueue) Reject(number int) (job Job, err error) {
+	err = queue.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(queue.name))
+		job, err = awaitingJob(bucket, number)
+		if err != nil {
+			return err
+		}
+		return rejectJob(bucket, &job, fmt.Errorf("rejected"))
+	})
+	if err == nil {
+		log.Printf("Job %d rejected", number)
+	}
+	return
+}
+
+// ExpireApprovals rejects the jobs that have waited for approval for too
+// long, returning them.
+func (queue *JobQueue) ExpireApprovals(now time.Time) (expired []Job, err error) {
+	err = queue.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(queue.name))
+		expired = nil
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var job Job
+			err := json.Unmarshal(v, &job)
+			if err != nil {
+				return err
+			}
+			if job.Status != AwaitingApproval || job.Approval.Expires.IsZero() || job.Approval.Expires.After(now) {
+				continue
+			}
+			// the cursor stays valid, since the key already exists
+			if err = rejectJob(bucket, &job, fmt.Errorf("approval expired")); err != nil {
+				return err
+			}
+			expired = append(expired, job)
+		}
+		return nil
+	})
+	return
+}
+
+func awaitingJob(bucket *bolt.Bucket, number int) (job Job, err error) {
+	buf := bucket.Get(itob(number))
+	if buf == nil {
+		return job, notFound("job #%d does not exist", number)
+	}
+	err = json.Unmarshal(buf, &job)
+	if err == nil && job.Status != AwaitingApproval {
+		err = fmt.Errorf("job #%d is %s, not awaiting approval", number,
+			strings.ToLower(job.Status.GetName()))
+	}
+	return
+}
+
+func rejectJob(bucket *bolt.Bucket, job *Job, reason error) error {
+	job.RecordStep("approval", "approval", job.Updated, reason)
+	job.Status = Cancelled
+	job.Updated = time.Now()
+	buf, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(itob(job.Number), buf)
+}
+
+// approvalWorker rejects jobs whose approval has expired once a minute, and
+// cleans up after them.
+func approvalWorker(queue *JobQueue, stop <-chan struct{}) {
+	logger := log.New(os.Stdout, "approval: ", log.LstdFlags)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		expired, err := queue.ExpireApprovals(time.Now())
+		if err != nil {
+			logger.Printf("Error expiring approvals: %v", err)
+		}
+		for _, job := range expired {
+			logger.Printf("Approval of job #%d expired", job.Number)
+			RemoveWorkspace(job.Number)
+		}
+	}
+}
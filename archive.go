@@ -0,0 +1,314 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ArchiveEntry is a file or directory to store in an archive under Name.
+type ArchiveEntry struct {
+	Name string
+	Path string
+}
+
+// WriteArchive writes a gzipped tarball of the given entries to writer.
+// Directories are stored recursively.  Symbolic links are stored as links,
+// and never followed.
+func WriteArchive(writer io.Writer, entries []ArchiveEntry) error {
+	compressed := gzip.NewWriter(writer)
+	archive := tar.NewWriter(compressed)
+
+	for _, entry := range entries {
+		err := filepath.Walk(entry.Path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(entry.Path, path)
+			if err != nil {
+				return err
+			}
+			return addToArchive(archive, filepath.ToSlash(filepath.Join(entry.Name, rel)), path, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+func addToArchive(archive *tar.Writer, name, path string, info os.FileInfo) error {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(path)
+		if err != nil {
+			return err
+		}
+	} else if !info.Mode().IsRegular() && !info.IsDir() {
+		// sockets, devices and the like can't be restored anyway
+		return nil
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	// owners are set by whoever extracts the archive
+	header.Uid, header.Gid = 0, 0
+	header.Uname, header.Gname = "", ""
+	if err = archive.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	// the file may have been replaced with a link since it was found
+	file, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(archive, file)
+	return err
+}
+
+// resolveEntry follows the links in the directories leading to path, which
+// have to stay inside root.  Archives are written as root from directories
+// that belong to the build user, so a link must not make root archive files
+// that the build couldn't read.  The last part of path is left as it is, so
+// that it is stored as a link if it is one.
+func resolveEntry(root, path string) (string, error) {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil || filepath.Clean(path) == filepath.Clean(root) {
+		return resolvedRoot, err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	resolved := filepath.Join(dir, filepath.Base(path))
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' is outside of '%s'", path, root)
+	}
+	return resolved, nil
+}
+
+// ExtractArchive extracts a gzipped tarball.  The first part of each name in
+// the archive picks the directory in roots it is extracted to, and entries
+// that don't match any of them are skipped.  Nothing is written outside of
+// the roots, even if the archive or the roots contain symbolic links.
+func ExtractArchive(reader io.Reader, roots map[string]string) error {
+	compressed, err := gzip.NewReader(reader)
+	if err != nil {
+		return err
+	}
+	defer compressed.Close()
+	archive := tar.NewReader(compressed)
+
+	// directories stay writable until everything has been extracted into
+	// them, and get their real modes at the end
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+	var dirs []dirMode
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			for i := len(dirs) - 1; i >= 0; i-- {
+				if err = os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		parts := strings.SplitN(name, string(filepath.Separator), 2)
+		root, ok := roots[parts[0]]
+		if !ok {
+			continue
+		}
+		rel := "."
+		if len(parts) == 2 {
+			rel = parts[1]
+		}
+		if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid name '%s' in archive", header.Name)
+		}
+		parent := filepath.Dir(rel)
+		if header.Typeflag == tar.TypeDir {
+			parent = rel
+		}
+		if err = checkNoSymlinks(root, parent); err != nil {
+			return err
+		}
+
+		path := filepath.Join(root, rel)
+		err = extractEntry(archive, header, path)
+		if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirMode{path, os.FileMode(header.Mode) & os.ModePerm})
+		}
+	}
+}
+
+// checkNoSymlinks makes sure that none of the directories leading from root
+// to rel are symbolic links, which could point outside of root.
+func checkNoSymlinks(root, rel string) error {
+	path := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." || part == "" {
+			continue
+		}
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("'%s' is a symbolic link, which could lead outside of '%s'", path, root)
+		}
+	}
+	return nil
+}
+
+func extractEntry(archive *tar.Reader, header *tar.Header, path string) error {
+	// only permission bits are kept, so that an archive can't create setuid
+	// files
+	mode := os.FileMode(header.Mode) & os.ModePerm
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		err := os.MkdirAll(path, 0755)
+		if err != nil {
+			return err
+		}
+		return os.Chmod(path, mode|0700)
+	case tar.TypeSymlink:
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = os.RemoveAll(path)
+		}
+		if err != nil {
+			return err
+		}
+		return os.Symlink(header.Linkname, path)
+	case tar.TypeReg:
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		// replace rather than write through whatever is there already
+		if err = os.RemoveAll(path); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, archive)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		return os.Chmod(path, mode)
+	}
+	return nil
+}
+
+// ArchiveFile describes an entry of an archive.
+type ArchiveFile struct {
+	Name string
+	Size int64
+	Mode os.FileMode
+}
+
+// ListArchive lists the entries of a gzipped tarball.
+func ListArchive(reader io.Reader) ([]ArchiveFile, error) {
+	compressed, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer compressed.Close()
+	archive := tar.NewReader(compressed)
+
+	var files []ArchiveFile
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, ArchiveFile{
+			Name: header.Name,
+			Size: header.Size,
+			Mode: header.FileInfo().Mode(),
+		})
+	}
+}
+
+// FilterArchive copies the entries of a gzipped tarball that match into a new
+// one, returning how many there were.
+func FilterArchive(writer io.Writer, reader io.Reader, match func(name string) bool) (int, error) {
+	compressed, err := gzip.NewReader(reader)
+	if err != nil {
+		return 0, err
+	}
+	defer compressed.Close()
+	input := tar.NewReader(compressed)
+
+	outputCompressed := gzip.NewWriter(writer)
+	output := tar.NewWriter(outputCompressed)
+	count := 0
+	for {
+		header, err := input.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if !match(header.Name) {
+			continue
+		}
+		if err = output.WriteHeader(header); err != nil {
+			return count, err
+		}
+		if _, err = io.Copy(output, input); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	if err = output.Close(); err != nil {
+		return count, err
+	}
+	return count, outputCompressed.Close()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// artifacts are stored under this name in their archive, so that they can be
+// extracted with ExtractArchive
+const artifactRoot = "build"
+
+func artifactPath(jobNumber int) string {
+	return filepath.Join(DATA_PATH, "artifacts", fmt.Sprintf("job-%d.tar.gz", jobNumber))
+}
+
+// SaveArtifacts archives the files in the build directory that match the
+// given patterns, keeping them after the build directory is removed.  Matches
+// reached through links to outside the build directory are refused.
+func SaveArtifacts(jobNumber int, build BuildConfig, patterns []string) (int, error) {
+	var entries []ArchiveEntry
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(build.Build, pattern))
+		if err != nil {
+			return 0, err
+		}
+		for _, match := range matches {
+			rel, err := filepath.Rel(build.Build, match)
+			if err != nil || seen[rel] {
+				continue
+			}
+			seen[rel] = true
+			path, err := resolveEntry(build.Build, match)
+			if err != nil {
+				return 0, err
+			}
+			entries = append(entries, ArchiveEntry{Name: filepath.Join(artifactRoot, rel), Path: path})
+		}
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	dest := artifactPath(jobNumber)
+	err := os.MkdirAll(filepath.Dir(dest), 0700)
+	if err != nil {
+		return 0, err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(dest), ".saving-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	err = WriteArchive(file, entries)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), os.Rename(file.Name(), dest)
+}
+
+// ListArtifacts lists the files archived for a job, with their names relative
+// to the build directory.
+func ListArtifacts(jobNumber int) ([]ArchiveFile, error) {
+	file, err := openArtifacts(jobNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries, err := ListArchive(file)
+	if err != nil {
+		return nil, err
+	}
+	var files []ArchiveFile
+	for _, entry := range entries {
+		name := strings.TrimPrefix(entry.Name, artifactRoot+"/")
+		if name == entry.Name || entry.Mode.IsDir() {
+			continue
+		}
+		entry.Name = name
+		files = append(files, entry)
+	}
+	return files, nil
+}
+
+// GetArtifacts returns an archive of the job's artifacts at name, which may
+// be a single file or a directory.
+func GetArtifacts(jobNumber int, name string) ([]byte, error) {
+	file, err := openArtifacts(jobNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	prefix := path.Join(artifactRoot, path.Clean("/"+filepath.ToSlash(name)))
+	var buffer bytes.Buffer
+	count, err := FilterArchive(&buffer, file, func(entry string) bool {
+		entry = strings.TrimSuffix(entry, "/")
+		return entry == prefix || strings.HasPrefix(entry, prefix+"/")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, notFound("job #%d has no artifact '%s'", jobNumber, name)
+	}
+	return buffer.Bytes(), nil
+}
+
+func openArtifacts(jobNumber int) (*os.File, error) {
+	file, err := os.Open(artifactPath(jobNumber))
+	if os.IsNotExist(err) {
+		return nil, notFound("job #%d has no artifacts", jobNumber)
+	}
+	return file, err
+}
+
+// RemoveExpiredArtifacts removes the artifacts of jobs that finished longer
+// than INTEGRAD_RETENTION ago.
+func RemoveExpiredArtifacts(logger *log.Logger) error {
+	if RETENTION == "" {
+		return nil
+	}
+	retention, err := time.ParseDuration(RETENTION)
+	if err != nil {
+		return fmt.Errorf("invalid retention '%s'", RETENTION)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(DATA_PATH, "artifacts", "job-*.tar.gz"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < retention {
+			continue
+		}
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+		logger.Printf("Removed expired artifacts %s", filepath.Base(path))
+	}
+	return nil
+}
+
+// archiveArtifacts saves the job's artifacts whether or not the deploy
+// succeeded, since the output of a failed build is often the most useful.
+func (d *deployment) archiveArtifacts() {
+	started := time.Now()
+	count, err := SaveArtifacts(d.job.Number, d.build, d.config.Artifacts)
+	d.job.RecordStep("artifacts", "archive", started, err)
+	if err != nil {
+		d.logger.Printf("Error while archiving artifacts: %v", err)
+	} else {
+		d.logger.Printf("Archived %d artifacts.", count)
+	}
+}
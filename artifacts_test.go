@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSaveArtifacts(t *testing.T) {
+	DATA_PATH = t.TempDir()
+	outside := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	build := t.TempDir()
+	for _, dir := range []string{"dist/docs", "out"} {
+		if err := os.MkdirAll(filepath.Join(build, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"dist/app", "dist/docs/index.html", "out/log"} {
+		if err := ioutil.WriteFile(filepath.Join(build, file), []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"linked":        outside,
+		"dist/external": filepath.Join(outside, "secret"),
+		"dist/internal": "../out",
+		"alias":         "dist",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(build, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		patterns []string
+		files    []string
+		fails    bool
+	}{
+		{patterns: []string{"dist/*"}, files: []string{"dist/app", "dist/docs/index.html", "dist/external", "dist/internal"}},
+		{patterns: []string{"out"}, files: []string{"out/log"}},
+		// links are stored as links rather than followed
+		{patterns: []string{"linked"}, files: []string{"linked"}},
+		// the directories leading to a match are followed, inside the
+		// build directory only
+		{patterns: []string{"alias/app"}, files: []string{"alias/app"}},
+		{patterns: []string{"linked/*"}, fails: true},
+		{patterns: []string{"dist/app", "linked/secret"}, fails: true},
+		{patterns: []string{"missing/*"}},
+	}
+	for i, test := range tests {
+		build := BuildConfig{Source: t.TempDir(), Build: build}
+		_, err := SaveArtifacts(i+1, build, test.patterns)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%v: expected an error", test.patterns)
+			}
+			if _, err = os.Stat(artifactPath(i + 1)); !os.IsNotExist(err) {
+				t.Errorf("%v: artifacts were saved", test.patterns)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.patterns, err)
+			continue
+		}
+
+		var names []string
+		listed, err := ListArtifacts(i + 1)
+		if err != nil && len(test.files) > 0 {
+			t.Errorf("%v: %v", test.patterns, err)
+			continue
+		}
+		for _, file := range listed {
+			names = append(names, file.Name)
+		}
+		if len(names) > 0 || len(test.files) > 0 {
+			if !reflect.DeepEqual(names, test.files) {
+				t.Errorf("%v: archived %v, expected %v", test.patterns, names, test.files)
+			}
+		}
+	}
+}
+
+func TestGetArtifactsNotFound(t *testing.T) {
+	DATA_PATH = t.TempDir()
+	build := BuildConfig{Source: t.TempDir(), Build: t.TempDir()}
+	if err := ioutil.WriteFile(filepath.Join(build.Build, "app"), []byte("app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SaveArtifacts(1, build, []string{"app"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetArtifacts(1, "app"); err != nil {
+		t.Errorf("app: %v", err)
+	}
+	var notFoundErr *NotFoundError
+	for _, test := range []struct {
+		job  int
+		name string
+	}{{1, "missing"}, {1, "ap"}, {2, "app"}} {
+		_, err := GetArtifacts(test.job, test.name)
+		if !errors.As(err, &notFoundErr) {
+			t.Errorf("job #%d, %s: got %v, expected a not found error", test.job, test.name, err)
+		}
+	}
+}
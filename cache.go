@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheConfig is the `cache` section of the configuration: directories that
+// are kept from one job of a project to the next.
+type CacheConfig struct {
+	// Key picks the saved copy to restore, usually from a hash of the files
+	// that decide what the directories hold, such as `go.sum`.
+	Key string
+	// Paths are the directories to keep, relative to the source directory.
+	Paths []string
+	// MaxSize is the largest compressed size that will be saved.
+	MaxSize Size `yaml:"max_size"`
+}
+
+// entries maps each of the cached paths into the source or build directory,
+// failing for paths outside of both.
+func (config CacheConfig) entries(build BuildConfig) ([]ArchiveEntry, error) {
+	var entries []ArchiveEntry
+	for _, path := range config.Paths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(build.Source, path)
+		}
+		path = filepath.Clean(path)
+
+		found := false
+		for name, root := range cacheRoots(build) {
+			rel, err := filepath.Rel(root, path)
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				entries = append(entries, ArchiveEntry{Name: filepath.Join(name, rel), Path: path})
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("'%s' is not inside the source or build directory", path)
+		}
+	}
+	return entries, nil
+}
+
+func cacheRoots(build BuildConfig) map[string]string {
+	return map[string]string{
+		"source": build.Source,
+		"build":  build.Build,
+	}
+}
+
+// BuildCache is the saved cache of a single project, stored under
+// INTEGRAD_DATA.
+type BuildCache struct {
+	dir    string
+	key    string
+	config CacheConfig
+	build  BuildConfig
+	// whether the restored cache was saved under the same key
+	hit bool
+}
+
+// protects the cache directory while old caches are evicted
+var cacheLock sync.Mutex
+
+func NewBuildCache(project string, config CacheConfig, build BuildConfig) *BuildCache {
+	key := "default"
+	if config.Key != "" {
+		key = hashString(config.Key)
+	}
+	return &BuildCache{
+		dir:    filepath.Join(DATA_PATH, "cache", hashString(project)),
+		key:    key,
+		config: config,
+		build:  build,
+	}
+}
+
+func (cache *BuildCache) path() string {
+	return filepath.Join(cache.dir, cache.key+".tar.gz")
+}
+
+// Restore extracts the saved cache for the current key.  If there isn't one,
+// the project's most recently used cache is restored instead, since it's
+// usually close enough to save most of the work.  It returns whether any
+// cache was found.
+func (cache *BuildCache) Restore() (found bool, err error) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	path := cache.path()
+	if _, err = os.Stat(path); err == nil {
+		cache.hit = true
+	} else if os.IsNotExist(err) {
+		path, err = newestFile(cache.dir, ".tar.gz")
+		if err != nil || path == "" {
+			return false, err
+		}
+	} else {
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	err = ExtractArchive(file, cacheRoots(cache.build))
+	if err != nil {
+		return false, err
+	}
+	// eviction goes by last use
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return true, nil
+}
+
+// Save stores the cached directories under the current key, then evicts the
+// least recently used caches of all projects until they fit in
+// INTEGRAD_CACHE_SIZE.  Paths below a symbolic link are refused.
+func (cache *BuildCache) Save() error {
+	entries, err := cache.config.entries(cache.build)
+	if err != nil {
+		return err
+	}
+	// the cache is archived as root from directories the build user owns, so
+	// the directories leading to each path must not be links, which could
+	// make root archive files the build couldn't read
+	roots := cacheRoots(cache.build)
+	var existing []ArchiveEntry
+	for _, entry := range entries {
+		parts := strings.SplitN(entry.Name, string(filepath.Separator), 2)
+		rel := "."
+		if len(parts) == 2 {
+			rel = parts[1]
+		}
+		if err = checkNoSymlinks(roots[parts[0]], filepath.Dir(rel)); err != nil {
+			return err
+		}
+		if _, err := os.Lstat(entry.Path); err == nil {
+			existing = append(existing, entry)
+		}
+	}
+
+	total, err := ParseSize(CACHE_SIZE)
+	if err != nil {
+		return err
+	}
+	limit := total
+	if cache.config.MaxSize > 0 && (limit == 0 || cache.config.MaxSize < limit) {
+		limit = cache.config.MaxSize
+	}
+
+	err = os.MkdirAll(cache.dir, 0700)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(cache.dir, ".saving-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	err = WriteArchive(file, existing)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(file.Name())
+	if err != nil {
+		return err
+	}
+	if limit > 0 && Size(info.Size()) > limit {
+		return fmt.Errorf("cache is %s, over the limit of %s", Size(info.Size()), limit)
+	}
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	err = os.Rename(file.Name(), cache.path())
+	if err != nil {
+		return err
+	}
+	return evictCaches(filepath.Join(DATA_PATH, "cache"), total)
+}
+
+// evictCaches removes the least recently used caches until the total size of
+// those left is within limit.
+func evictCaches(dir string, limit Size) error {
+	if limit <= 0 {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*", "*.tar.gz"))
+	if err != nil {
+		return err
+	}
+
+	var total Size
+	infos := make(map[string]os.FileInfo)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		infos[path] = info
+		total += Size(info.Size())
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return infos[paths[i]].ModTime().Before(infos[paths[j]].ModTime())
+	})
+
+	for _, path := range paths {
+		if total <= limit {
+			break
+		}
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+		total -= Size(infos[path].Size())
+	}
+	return nil
+}
+
+// newestFile returns the most recently modified file in dir with the given
+// suffix, or an empty string if there is none.
+func newestFile(dir, suffix string) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+suffix))
+	if err != nil {
+		return "", err
+	}
+	var newest string
+	var newestTime time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if newest == "" || info.ModTime().After(newestTime) {
+			newest, newestTime = path, info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+func hashString(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
+
+// hashFiles returns a hash of the names and contents of the files in dir
+// matching the patterns, for use in cache keys.  Missing files are skipped,
+// so that a configuration can be rendered before the source is checked out.
+func hashFiles(dir string, patterns ...string) (string, error) {
+	var paths []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return "", err
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+
+	hash := sha256.New()
+	for i, path := range paths {
+		if i > 0 && path == paths[i-1] {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		if info.IsDir() {
+			continue
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		fmt.Fprintf(hash, "%s\x00", rel)
+		_, err = io.Copy(hash, file)
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:8]), nil
+}
+
+// restoreCache restores the project's cache before the build.  Failing to do
+// so only makes the build slower, so errors are logged and otherwise ignored.
+func (d *deployment) restoreCache() {
+	started := time.Now()
+	found, err := d.cache.Restore()
+	d.job.RecordStep("cache", "restore", started, err)
+	switch {
+	case err != nil:
+		d.logger.Printf("Error while restoring the cache: %v", err)
+	case d.cache.hit:
+		d.logger.Println("Restored the cache.")
+	case found:
+		d.logger.Println("No cache saved for this key, restored the most recent one.")
+	default:
+		d.logger.Println("No cache saved yet.")
+	}
+}
+
+// saveCache saves the project's cache after a successful deploy.  A cache
+// that was restored from the same key is left as it is, unless there is no
+// key, in which case it is always replaced.
+func (d *deployment) saveCache() {
+	if d.cache.hit && d.config.Cache.Key != "" {
+		return
+	}
+	started := time.Now()
+	err := d.cache.Save()
+	d.job.RecordStep("cache", "save", started, err)
+	if err != nil {
+		d.logger.Printf("Error while saving the cache: %v", err)
+	} else {
+		d.logger.Println("Saved the cache.")
+	}
+}
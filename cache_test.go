@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildCacheSave(t *testing.T) {
+	DATA_PATH = t.TempDir()
+	CACHE_SIZE = "1G"
+	outside := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(outside, "cache"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "cache", "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		links   map[string]string
+		paths   []string
+		entries int
+		fails   bool
+	}{
+		{name: "plain directory", paths: []string{"deps"}, entries: 2},
+		{name: "missing directory", paths: []string{"missing/cache"}},
+		// the link itself is stored, rather than what it points to
+		{name: "link as the cached path", links: map[string]string{"deps": outside}, paths: []string{"deps"}, entries: 1},
+		{name: "link to outside", links: map[string]string{"vendor": outside}, paths: []string{"vendor/cache"}, fails: true},
+		{name: "link inside the source", links: map[string]string{"vendor": "deps"}, paths: []string{"vendor/file"}, fails: true},
+	}
+	for _, test := range tests {
+		build := BuildConfig{Source: t.TempDir(), Build: t.TempDir()}
+		if test.links["deps"] == "" {
+			if err := os.MkdirAll(filepath.Join(build.Source, "deps"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(build.Source, "deps", "file"), []byte("file"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for name, target := range test.links {
+			if err := os.Symlink(target, filepath.Join(build.Source, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		cache := NewBuildCache(test.name, CacheConfig{Paths: test.paths}, build)
+		err := cache.Save()
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		archive, err := ioutil.ReadFile(cache.path())
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		files, err := ListArchive(bytes.NewReader(archive))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		for _, file := range files {
+			if filepath.Base(file.Name) == "secret" {
+				t.Errorf("%s: archived %s", test.name, file.Name)
+			}
+		}
+		if len(files) != test.entries {
+			t.Errorf("%s: archived %d entries, expected %d", test.name, len(files), test.entries)
+		}
+	}
+}
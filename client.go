@@ -1,11 +1,19 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const DATE_LAYOUT = "2006-01-02 03:04:05"
@@ -28,7 +36,38 @@ type DeployResponse struct {
 	Job Job
 }
 
+type SecretsResponse struct {
+	Names []string
+}
+
+type ArtifactsResponse struct {
+	Files []ArchiveFile
+}
+
+type ArtifactResponse struct {
+	Archive []byte
+}
+
+type SchedulesResponse struct {
+	Schedules []Schedule
+}
+
+type DeploymentsResponse struct {
+	Deployments []Deployment
+}
+
+type ErrorResponse struct {
+	Error string
+	// NotFound is set when the error is a *NotFoundError.
+	NotFound bool `json:",omitempty"`
+}
+
 func StatusCommand(args []string, options map[string]string) int {
+	output, err := ParseOutput(options)
+	if err != nil {
+		return commandError(err)
+	}
+
 	jobArgs := make(map[string]string)
 	jobNumber, singleJob := options["job"]
 	if singleJob {
@@ -40,29 +79,82 @@ func StatusCommand(args []string, options map[string]string) int {
 	}
 
 	var response StatusResponse
-	err := sendCommand(command, &response)
+	err = sendCommand(command, &response)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return 1
+		return commandError(err)
 	}
 
 	if singleJob {
 		job := response.Statuses[0]
-		fmt.Printf("Job status for Job #%d: %s as of %s\n",
-			job.Number, job.Status.GetName(), job.Updated.Format(DATE_LAYOUT))
+		err = output.Print(job, func() { printJobStatus(job) })
 	} else {
-		fmt.Printf("%6s %10s %20s\n", "JOB", "STATUS", "UPDATED")
-		for _, job := range response.Statuses {
-			name := fmt.Sprintf("#%d", job.Number)
-			fmt.Printf("%6s %10s %20s\n",
-				name, job.Status.GetName(), job.Updated.Format(DATE_LAYOUT))
+		err = output.Print(response.Statuses, func() { printJobList(response.Statuses) })
+	}
+	if err != nil {
+		return commandError(err)
+	}
+	return ExitSuccess
+}
+
+func printJobStatus(job Job) {
+	fmt.Printf("Job status for Job #%d: %s as of %s\n",
+		job.Number, job.Status.GetName(), job.Updated.Format(DATE_LAYOUT))
+	if job.Environment != "" {
+		fmt.Printf("Environment: %s\n", job.Environment)
+	}
+	if job.SupersededBy != 0 {
+		fmt.Printf("Superseded by Job #%d\n", job.SupersededBy)
+	}
+	if job.Status == AwaitingApproval && !job.Approval.Expires.IsZero() {
+		fmt.Printf("Rejected unless approved by %s\n", job.Approval.Expires.Format(DATE_LAYOUT))
+	}
+	if job.Parent != 0 {
+		fmt.Printf("Triggered by Job #%d\n", job.Parent)
+	}
+	if len(job.Children) > 0 {
+		children := make([]string, len(job.Children))
+		for i, number := range job.Children {
+			children[i] = fmt.Sprintf("#%d", number)
+		}
+		fmt.Printf("Triggered Jobs %s\n", strings.Join(children, ", "))
+	}
+	if len(job.Steps) > 0 {
+		fmt.Printf("\n%-12s %-30s %10s %10s %8s\n", "PHASE", "STEP", "STATUS", "DURATION", "ATTEMPTS")
+		cell := ""
+		for _, step := range job.Steps {
+			// steps of each matrix cell are listed under the cell's
+			// variables
+			if step.Cell != cell {
+				cell = step.Cell
+				if cell != "" {
+					fmt.Printf("%-12s [%s]\n", "", cell)
+				}
+			}
+			attempts := ""
+			if step.Attempts > 1 {
+				attempts = fmt.Sprintf("%d", step.Attempts)
+			}
+			fmt.Printf("%-12s %-30s %10s %10s %8s\n", step.Phase, step.Name,
+				step.Status.GetName(), step.Duration.Round(time.Millisecond), attempts)
 		}
 	}
+}
 
-	return 0
+func printJobList(jobs []Job) {
+	fmt.Printf("%6s %10s %20s  %s\n", "JOB", "STATUS", "UPDATED", "ENVIRONMENT")
+	for _, job := range jobs {
+		name := fmt.Sprintf("#%d", job.Number)
+		fmt.Printf("%6s %10s %20s  %s\n",
+			name, job.Status.GetName(), job.Updated.Format(DATE_LAYOUT), job.Environment)
+	}
 }
 
 func LogsCommand(args []string, options map[string]string) int {
+	output, err := ParseOutput(options)
+	if err != nil {
+		return commandError(err)
+	}
+
 	command := ClientCommand{
 		Command: "logs",
 		Args: map[string]string{
@@ -71,30 +163,37 @@ func LogsCommand(args []string, options map[string]string) int {
 	}
 	var response LogsResponse
 
-	err := sendCommand(command, &response)
+	err = sendCommand(command, &response)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return 1
+		return commandError(err)
 	}
 
-	fmt.Printf("Logs for Job #%d\n\n", response.Job.Number)
+	err = output.Print(response, func() {
+		fmt.Printf("Logs for Job #%d\n\n", response.Job.Number)
 
-	for _, msg := range response.Logs {
-		fmt.Print(msg)
+		for _, msg := range response.Logs {
+			fmt.Print(msg)
+		}
+	})
+	if err != nil {
+		return commandError(err)
 	}
-
-	return 0
+	return ExitSuccess
 }
 
 func DeployCommand(args []string, options map[string]string) int {
+	output, err := ParseOutput(options)
+	if err != nil {
+		return commandError(err)
+	}
+
 	absPath, err := filepath.Abs(args[0])
 	if err != nil {
-		fmt.Printf("Error: %v\n", absPath)
+		return commandError(err)
 	}
 
 	if _, ok := options["git"]; !ok {
-		fmt.Printf("Error: a git commit must be provided.")
-		return 1
+		return commandError(errors.New("a git commit must be provided"))
 	}
 
 	command := ClientCommand{
@@ -104,36 +203,268 @@ func DeployCommand(args []string, options map[string]string) int {
 			"git":    options["git"],
 		},
 	}
+	if ref, ok := options["ref"]; ok {
+		command.Args["ref"] = ref
+	}
+	if priority, ok := options["priority"]; ok {
+		command.Args["priority"] = priority
+	}
+	if after, ok := options["after"]; ok {
+		command.Args["after"] = after
+	}
+	if env, ok := options["env"]; ok {
+		command.Args["env"] = env
+	}
+
+	return sendJobCommand(command, output, options)
+}
+
+func RestartCommand(args []string, options map[string]string) int {
+	output, err := ParseOutput(options)
+	if err != nil {
+		return commandError(err)
+	}
+
+	command := ClientCommand{
+		Command: "restart",
+		Args: map[string]string{
+			"job": args[0],
+		},
+	}
+	return sendJobCommand(command, output, options)
+}
+
+// sendJobCommand sends a command that creates a job, and prints the job, or
+// waits for it to finish if the wait option is set.
+func sendJobCommand(command ClientCommand, output Output, options map[string]string) int {
 	var response DeployResponse
 
-	err = sendCommand(command, &response)
+	err := sendCommand(command, &response)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return 1
+		return commandError(err)
 	}
 
-	fmt.Printf("Created job #%d.\n", response.Job.Number)
+	if _, ok := options["wait"]; ok {
+		fmt.Fprintf(output.progress(), "Created job #%d, waiting for it to finish.\n", response.Job.Number)
+		_, streamLogs := options["logs"]
+		return waitForJob(response.Job.Number, streamLogs, output)
+	}
 
-	return 0
+	err = output.Print(response.Job, func() {
+		fmt.Printf("Created job #%d.\n", response.Job.Number)
+	})
+	if err != nil {
+		return commandError(err)
+	}
+	return ExitSuccess
 }
 
-func RestartCommand(args []string, options map[string]string) int {
+// waitInterval is how often a waiting client asks the server about its job.
+const waitInterval = time.Second
+
+func WaitCommand(args []string, options map[string]string) int {
+	output, err := ParseOutput(options)
+	if err != nil {
+		return commandError(err)
+	}
+	number, err := strconv.Atoi(args[0])
+	if err != nil {
+		return commandError(err)
+	}
+	_, streamLogs := options["logs"]
+	return waitForJob(number, streamLogs, output)
+}
+
+// waitForJob polls the server until a job has finished, then prints it and
+// returns the exit code for its status.  A superseded job is followed to the
+// job that replaced it.  A job waiting for approval ends the wait, since
+// nobody may approve it for hours.
+func waitForJob(number int, streamLogs bool, output Output) int {
+	progress := output.progress()
+	printed := 0
+	for {
+		job, logs, err := pollJob(number, streamLogs, printed)
+		if err != nil {
+			return commandError(err)
+		}
+		for _, msg := range logs {
+			fmt.Fprint(progress, msg)
+		}
+		printed += len(logs)
+
+		if job.Status == Superseded && job.SupersededBy != 0 {
+			fmt.Fprintf(progress, "Job #%d was superseded by job #%d, waiting for it instead.\n",
+				number, job.SupersededBy)
+			number = job.SupersededBy
+			printed = 0
+			continue
+		}
+		if job.Status == Queued || job.Status == Active {
+			time.Sleep(waitInterval)
+			continue
+		}
+
+		if streamLogs {
+			fmt.Fprintln(progress)
+		}
+		err = output.Print(job, func() { printJobStatus(job) })
+		if err != nil {
+			return commandError(err)
+		}
+		return jobExitCode(job.Status)
+	}
+}
+
+// pollJob fetches a job, along with the lines of its logs after the first
+// skip if logs are wanted.
+func pollJob(number int, withLogs bool, skip int) (Job, []string, error) {
+	args := map[string]string{"job": strconv.Itoa(number)}
+	if withLogs {
+		args["from"] = strconv.Itoa(skip)
+		var response LogsResponse
+		err := sendCommand(ClientCommand{Command: "logs", Args: args}, &response)
+		return response.Job, response.Logs, err
+	}
+
+	var response StatusResponse
+	err := sendCommand(ClientCommand{Command: "status", Args: args}, &response)
+	if err != nil {
+		return Job{}, nil, err
+	}
+	return response.Statuses[0], nil, nil
+}
+
+func ApproveCommand(args []string, options map[string]string) int {
+	return sendApprovalCommand("approve", args[0], "approved, and queued to deploy")
+}
+
+func RejectCommand(args []string, options map[string]string) int {
+	return sendApprovalCommand("reject", args[0], "rejected")
+}
+
+func sendApprovalCommand(name, job, outcome string) int {
 	command := ClientCommand{
-		Command: "restart",
+		Command: name,
 		Args: map[string]string{
-			"job": args[0],
+			"job": job,
 		},
 	}
 	var response DeployResponse
 
 	err := sendCommand(command, &response)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return 1
+		return commandError(err)
+	}
+
+	fmt.Printf("Job #%d %s.\n", response.Job.Number, outcome)
+	return 0
+}
+
+func ValidateCommand(args []string, options map[string]string) int {
+	dir := "."
+	if len(args) > 0 {
+		dir = args[0]
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "deploy.yaml"))
+	if err != nil {
+		return commandError(err)
+	}
+
+	_, err = ParseConfig(contents, ValidationBuild)
+	if err != nil {
+		return commandError(err)
+	}
+
+	fmt.Println("deploy.yaml is valid.")
+	return 0
+}
+
+func RunLocalCommand(args []string, options map[string]string) int {
+	dir := "."
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return commandError(err)
+	}
+
+	if _, ok := options["dry-run"]; ok {
+		err = DryRun(dir, options["env"], os.Stdout)
+	} else {
+		_, noDeploy := options["no-deploy"]
+		logger := log.New(os.Stdout, "", log.LstdFlags)
+		err = RunLocal(dir, options["env"], LocalOptions{NoDeploy: noDeploy}, logger)
+	}
+	if err != nil {
+		return commandError(err)
+	}
+	return 0
+}
+
+func SecretSetCommand(args []string, options map[string]string) int {
+	var value string
+	if len(args) > 1 {
+		value = args[1]
+	} else {
+		raw, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return commandError(err)
+		}
+		value = strings.TrimRight(string(raw), "\r\n")
+	}
+
+	command := ClientCommand{
+		Command: "secret-set",
+		Args: map[string]string{
+			"name":  args[0],
+			"value": value,
+		},
 	}
 
-	fmt.Printf("Created job #%d.\n", response.Job.Number)
+	err := sendCommand(command, nil)
+	if err != nil {
+		return commandError(err)
+	}
 
+	fmt.Printf("Set secret '%s'.\n", args[0])
+	return 0
+}
+
+func SecretListCommand(args []string, options map[string]string) int {
+	command := ClientCommand{
+		Command: "secret-list",
+		Args:    map[string]string{},
+	}
+	var response SecretsResponse
+
+	err := sendCommand(command, &response)
+	if err != nil {
+		return commandError(err)
+	}
+
+	for _, name := range response.Names {
+		fmt.Println(name)
+	}
+
+	return 0
+}
+
+func SecretRemoveCommand(args []string, options map[string]string) int {
+	command := ClientCommand{
+		Command: "secret-rm",
+		Args: map[string]string{
+			"name": args[0],
+		},
+	}
+
+	err := sendCommand(command, nil)
+	if err != nil {
+		return commandError(err)
+	}
+
+	fmt.Printf("Removed secret '%s'.\n", args[0])
 	return 0
 }
 
@@ -145,8 +476,211 @@ func ShutdownCommand(args []string, options map[string]string) int {
 
 	err := sendCommand(command, nil)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return 1
+		return commandError(err)
+	}
+
+	return 0
+}
+
+func ArtifactsCommand(args []string, options map[string]string) int {
+	command := ClientCommand{
+		Command: "artifacts",
+		Args: map[string]string{
+			"job": args[0],
+		},
+	}
+	var response ArtifactsResponse
+
+	err := sendCommand(command, &response)
+	if err != nil {
+		return commandError(err)
+	}
+
+	fmt.Printf("%10s  %s\n", "SIZE", "NAME")
+	for _, file := range response.Files {
+		fmt.Printf("%10s  %s\n", Size(file.Size), file.Name)
+	}
+
+	return 0
+}
+
+func ArtifactsGetCommand(args []string, options map[string]string) int {
+	command := ClientCommand{
+		Command: "artifacts-get",
+		Args: map[string]string{
+			"job":  args[0],
+			"path": args[1],
+		},
+	}
+	var response ArtifactResponse
+
+	err := sendCommand(command, &response)
+	if err != nil {
+		return commandError(err)
+	}
+
+	dest := "."
+	if dir, ok := options["dest"]; ok {
+		dest = dir
+	}
+	err = ExtractArchive(bytes.NewReader(response.Archive), map[string]string{artifactRoot: dest})
+	if err != nil {
+		return commandError(err)
+	}
+
+	return 0
+}
+
+func QueueCommand(args []string, options map[string]string) int {
+	return sendQueueCommand(ClientCommand{
+		Command: "queue",
+		Args:    map[string]string{},
+	})
+}
+
+func QueueMoveCommand(args []string, options map[string]string) int {
+	return sendQueueCommand(ClientCommand{
+		Command: "queue-move",
+		Args: map[string]string{
+			"job":      args[0],
+			"position": args[1],
+		},
+	})
+}
+
+func QueueRemoveCommand(args []string, options map[string]string) int {
+	return sendQueueCommand(ClientCommand{
+		Command: "queue-rm",
+		Args: map[string]string{
+			"job": args[0],
+		},
+	})
+}
+
+// sendQueueCommand sends a queue command and prints the resulting queue.
+func sendQueueCommand(command ClientCommand) int {
+	var response StatusResponse
+
+	err := sendCommand(command, &response)
+	if err != nil {
+		return commandError(err)
+	}
+
+	if len(response.Statuses) == 0 {
+		fmt.Println("No jobs queued.")
+		return 0
+	}
+	fmt.Printf("%4s %6s %8s %20s  %s\n", "POS", "JOB", "PRIORITY", "QUEUED", "SOURCE")
+	for i, job := range response.Statuses {
+		name := fmt.Sprintf("#%d", job.Number)
+		fmt.Printf("%4d %6s %8s %20s  %s\n", i+1, name, job.Priority.GetName(),
+			job.Updated.Format(DATE_LAYOUT), job.Args["source"])
+		if len(job.After) > 0 {
+			after := make([]string, len(job.After))
+			for j, number := range job.After {
+				after[j] = fmt.Sprintf("#%d", number)
+			}
+			fmt.Printf("%4s %6s after %s\n", "", "", strings.Join(after, ", "))
+		}
+	}
+
+	return 0
+}
+
+func ScheduleAddCommand(args []string, options map[string]string) int {
+	absPath, err := filepath.Abs(args[0])
+	if err != nil {
+		return commandError(err)
+	}
+
+	if _, ok := options["git"]; !ok {
+		return commandError(errors.New("a git ref must be provided"))
+	}
+
+	command := ClientCommand{
+		Command: "schedule-add",
+		Args: map[string]string{
+			"source": absPath,
+			"git":    options["git"],
+			"cron":   args[1],
+		},
+	}
+	var response SchedulesResponse
+
+	err = sendCommand(command, &response)
+	if err != nil {
+		return commandError(err)
+	}
+
+	schedule := response.Schedules[len(response.Schedules)-1]
+	fmt.Printf("Created schedule %d, next running at %s.\n",
+		schedule.ID, schedule.Next.Format(DATE_LAYOUT))
+
+	return 0
+}
+
+func ScheduleListCommand(args []string, options map[string]string) int {
+	command := ClientCommand{
+		Command: "schedule-list",
+		Args:    map[string]string{},
+	}
+	var response SchedulesResponse
+
+	err := sendCommand(command, &response)
+	if err != nil {
+		return commandError(err)
+	}
+
+	fmt.Printf("%4s %-16s %20s  %-12s %s\n", "ID", "CRON", "NEXT RUN", "REF", "SOURCE")
+	for _, schedule := range response.Schedules {
+		fmt.Printf("%4d %-16s %20s  %-12s %s\n", schedule.ID, schedule.Cron,
+			schedule.Next.Format(DATE_LAYOUT), schedule.Ref, schedule.Source)
+	}
+
+	return 0
+}
+
+func DeploymentsCommand(args []string, options map[string]string) int {
+	command := ClientCommand{
+		Command: "deployments",
+		Args:    map[string]string{},
+	}
+	var response DeploymentsResponse
+
+	err := sendCommand(command, &response)
+	if err != nil {
+		return commandError(err)
+	}
+
+	if len(response.Deployments) == 0 {
+		fmt.Println("Nothing has been deployed yet.")
+		return 0
+	}
+	fmt.Printf("%-12s %6s %20s  %-12s %s\n", "ENVIRONMENT", "JOB", "DEPLOYED", "VERSION", "SOURCE")
+	for _, deployment := range response.Deployments {
+		environment := deployment.Environment
+		if environment == "" {
+			environment = "-"
+		}
+		name := fmt.Sprintf("#%d", deployment.Job)
+		fmt.Printf("%-12s %6s %20s  %-12s %s\n", environment, name,
+			deployment.Time.Format(DATE_LAYOUT), deployment.Version, deployment.Source)
+	}
+
+	return 0
+}
+
+func ScheduleRemoveCommand(args []string, options map[string]string) int {
+	command := ClientCommand{
+		Command: "schedule-rm",
+		Args: map[string]string{
+			"id": args[0],
+		},
+	}
+
+	err := sendCommand(command, nil)
+	if err != nil {
+		return commandError(err)
 	}
 
 	return 0
@@ -166,9 +700,20 @@ func sendCommand(command ClientCommand, response interface{}) error {
 
 	fmt.Fprintf(conn, "%s\n", string(buffer))
 
-	scanner := bufio.NewScanner(conn)
-	scanner.Scan()
-	rawResponse := scanner.Bytes()
+	// responses can be much longer than a scanner allows for a line
+	var rawResponse json.RawMessage
+	err = json.NewDecoder(conn).Decode(&rawResponse)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	var errResponse ErrorResponse
+	if json.Unmarshal(rawResponse, &errResponse) == nil && errResponse.Error != "" {
+		if errResponse.NotFound {
+			return &NotFoundError{Message: errResponse.Error}
+		}
+		return errors.New(errResponse.Error)
+	}
 
 	if response != nil {
 		err = json.Unmarshal(rawResponse, &response)
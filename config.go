@@ -2,10 +2,15 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/template"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -16,10 +21,63 @@ type BuildConfig struct {
 }
 
 type Config struct {
-	Env    map[string]string
-	Build  []string
-	Deploy map[string]string
-	Post   []string
+	User      string
+	Sandbox   Sandbox
+	Limits    Limits
+	Fetch     Retry
+	After     []string
+	Triggers  []Trigger
+	Env       EnvList
+	Secrets   map[string]string
+	Matrix    Matrix
+	Build     []Step
+	Approval  ApprovalGate
+	Deploy    DeployList
+	Post      []Step
+	OnSuccess []Step `yaml:"on_success"`
+	OnFailure []Step `yaml:"on_failure"`
+	Always    []Step
+	Cache     *CacheConfig
+	Artifacts []string
+	Health    *HealthCheck `yaml:"healthcheck"`
+
+	// Environments are named variations of env, deploy and post, one of
+	// which can be chosen for each job.
+	Environments map[string]Environment
+}
+
+// Duration is a time.Duration written in the configuration as a string such
+// as "30s" or "5m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration '%s'", value)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// yamlTypeNames replaces the Go type names in YAML errors with the names of
+// the matching configuration sections.
+var yamlTypeNames = strings.NewReplacer(
+	"type main.Config", "the configuration",
+	"type main.plainStep", "step",
+	"type main.DeployEntry", "deploy entry",
+	"type main.HealthCheck", "healthcheck",
+	"type main.plainHealthCheck", "healthcheck",
+)
+
+// ValidationBuild holds the placeholder paths used to render a configuration
+// when it is only being checked, rather than run.
+var ValidationBuild = BuildConfig{
+	Source: "/tmp/integrad/source-validate",
+	Build:  "/tmp/integrad/build-validate",
 }
 
 func LoadConfig(build BuildConfig) (config Config, err error) {
@@ -31,19 +89,230 @@ func LoadConfig(build BuildConfig) (config Config, err error) {
 	defer file.Close()
 
 	b, err := ioutil.ReadAll(file)
-	contents := string(b)
-
-	template, err := template.New("config").Parse(contents)
 	if err != nil {
 		return
 	}
 
+	return ParseConfig(b, build)
+}
+
+// RenderConfig renders the template of a deploy.yaml file with the given
+// build paths.
+func RenderConfig(contents []byte, build BuildConfig) ([]byte, error) {
+	funcs := template.FuncMap{
+		"hashFiles": func(patterns ...string) (string, error) {
+			return hashFiles(build.Source, patterns...)
+		},
+	}
+	template, err := template.New("deploy.yaml").Funcs(funcs).Parse(string(contents))
+	if err != nil {
+		return nil, err
+	}
+
 	buffer := new(bytes.Buffer)
 	err = template.Execute(buffer, build)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// ParseConfig renders the contents of a deploy.yaml file with the given build
+// paths and parses the result.  Unknown keys are treated as errors, and the
+// configuration is validated before it is returned.
+func ParseConfig(contents []byte, build BuildConfig) (config Config, err error) {
+	rendered, err := RenderConfig(contents, build)
 	if err != nil {
 		return
 	}
 
-	err = yaml.Unmarshal(buffer.Bytes(), &config)
+	err = yaml.UnmarshalStrict(rendered, &config)
+	if err != nil {
+		err = errors.New(yamlTypeNames.Replace(err.Error()))
+		return
+	}
+
+	err = config.Validate(build, rendered)
 	return
 }
+
+// Validate checks the parts of the configuration that can't be expressed in
+// its types, such as required keys.  All problems are reported at once, each
+// with its line in source, the rendered text the configuration was parsed
+// from, if it is given.
+func (config Config) Validate(build BuildConfig, source []byte) error {
+	var problems []string
+	lines := indexLines(source)
+	report := func(path, format string, args ...interface{}) {
+		problem := fmt.Sprintf(format, args...)
+		if number, ok := lines.find(path); ok {
+			problem = fmt.Sprintf("line %d: %s", number, problem)
+		}
+		problems = append(problems, problem)
+	}
+
+	checkSteps := func(section string, steps []Step) {
+		for i, step := range steps {
+			path := fmt.Sprintf("%s.%d", section, i)
+			if len(step.Parallel) > 0 {
+				if step.Run != "" {
+					report(path, "%s: %s has both a command and parallel steps",
+						section, step.Label(section, i))
+				}
+				if step.Dir != "" || len(step.Env) > 0 || step.Shell != "" || step.Timeout != 0 || step.Retries != 0 || step.Privileged {
+					report(path, "%s: %s can only set name and continue_on_error besides its parallel steps",
+						section, step.Label(section, i))
+				}
+				for j, child := range step.Parallel {
+					if len(child.Parallel) > 0 {
+						report(fmt.Sprintf("%s.parallel.%d", path, j), "%s: %s can't have parallel steps of its own",
+							section, child.childLabel(section, i, j))
+					}
+				}
+			}
+			eachStep(section, i, step, func(label, path string, step Step) {
+				if strings.TrimSpace(step.Run) == "" && len(step.Parallel) == 0 {
+					report(path, "%s: %s has nothing to run", section, label)
+				}
+				if step.Timeout < 0 {
+					report(path+".timeout", "%s: %s has a negative timeout", section, label)
+				}
+				if step.Retries < 0 {
+					report(path+".retries", "%s: %s has negative retries or backoff", section, label)
+				} else if step.Backoff < 0 {
+					report(path+".backoff", "%s: %s has negative retries or backoff", section, label)
+				}
+			})
+		}
+	}
+	for env, name := range config.Secrets {
+		if strings.TrimSpace(name) == "" {
+			report("secrets."+env, "secrets: no secret name given for %s", env)
+		}
+	}
+
+	for i, step := range config.Build {
+		eachStep("build", i, step, func(label, path string, step Step) {
+			if step.Privileged {
+				report(path, "build: %s can't be privileged, only post steps can", label)
+			}
+		})
+	}
+	hooks := map[string][]Step{
+		"on_success": config.OnSuccess,
+		"on_failure": config.OnFailure,
+		"always":     config.Always,
+	}
+	for section, steps := range hooks {
+		for i, step := range steps {
+			eachStep(section, i, step, func(label, path string, step Step) {
+				if step.Privileged {
+					report(path, "%s: %s can't be privileged, only post steps can", section, label)
+				}
+			})
+		}
+	}
+
+	checkSteps("build", config.Build)
+	checkSteps("post", config.Post)
+	checkSteps("on_success", config.OnSuccess)
+	checkSteps("on_failure", config.OnFailure)
+	checkSteps("always", config.Always)
+
+	checkDeploy := func(section string, entries DeployList) {
+		for i, entry := range entries {
+			path := fmt.Sprintf("%s.%d", section, i)
+			if entry.Source == "" || entry.Dest == "" {
+				report(path, "%s: entry %d needs both a source and a dest", section, i+1)
+			}
+			if _, err := entry.FileMode(); err != nil {
+				report(path, "%s: entry %d: %v", section, i+1, err)
+			}
+			for _, pattern := range entry.Exclude {
+				if _, err := filepath.Match(pattern, ""); err != nil {
+					report(path, "%s: entry %d: invalid exclude pattern '%s'", section, i+1, pattern)
+				}
+			}
+		}
+	}
+	checkDeploy("deploy", config.Deploy)
+
+	for _, name := range config.EnvironmentNames() {
+		section := "environments." + name
+		checkDeploy(section+".deploy", config.Environments[name].Deploy)
+		checkSteps(section+".post", config.Environments[name].Post)
+	}
+
+	if health := config.Health; health != nil {
+		if (health.Command == "") == (health.URL == "") {
+			report("healthcheck", "healthcheck: exactly one of command or url must be set")
+		}
+		if health.URL != "" {
+			if parsed, err := url.Parse(health.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+				report("healthcheck.url", "healthcheck: '%s' is not an http or https URL", health.URL)
+			}
+		}
+		if health.Retries < 0 || health.Interval < 0 || health.Timeout < 0 {
+			report("healthcheck", "healthcheck: retries, interval and timeout can't be negative")
+		}
+	}
+
+	if cache := config.Cache; cache != nil {
+		if len(cache.Paths) == 0 {
+			report("cache", "cache: no paths given")
+		}
+		if _, err := cache.entries(build); err != nil {
+			report("cache", "cache: %v", err)
+		}
+	}
+
+	for i, pattern := range config.Artifacts {
+		_, err := filepath.Match(pattern, "")
+		clean := filepath.Clean(pattern)
+		if err != nil || filepath.IsAbs(pattern) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			report(fmt.Sprintf("artifacts.%d", i), "artifacts: '%s' is not a pattern inside the build directory", pattern)
+		}
+	}
+
+	for i, source := range config.After {
+		if !filepath.IsAbs(source) {
+			report(fmt.Sprintf("after.%d", i), "after: '%s' is not an absolute path", source)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, axis := range config.Matrix {
+		path := fmt.Sprintf("matrix.%d", i)
+		if len(axis.Values) == 0 {
+			report(path, "matrix: '%s' has no values", axis.Name)
+		}
+		if names[axis.Name] {
+			report(path, "matrix: '%s' is given more than once", axis.Name)
+		}
+		names[axis.Name] = true
+	}
+
+	for i, trigger := range config.Triggers {
+		if !filepath.IsAbs(trigger.Source) || trigger.Ref == "" {
+			report(fmt.Sprintf("triggers.%d", i), "triggers: '%s' needs an absolute source path and a ref", trigger.Source)
+		}
+	}
+
+	if config.Approval.Expiry < 0 {
+		report("approval.expiry", "approval: expiry can't be negative")
+	}
+
+	if config.Fetch.Retries < 0 || config.Fetch.Backoff < 0 {
+		report("fetch", "fetch: retries and backoff can't be negative")
+	}
+
+	limits := config.Limits
+	if limits.CPU < 0 || limits.Processes < 0 {
+		report("limits", "limits: cpu and processes can't be negative")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed cron expression with the usual five fields:
+// minute, hour, day of month, month and day of week.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// whether the day of month and day of week fields start with `*`.  Unless
+	// one of them does, both are restricted and a day matching either of
+	// them is enough.
+	domStar, dowStar bool
+}
+
+type cronField struct {
+	min, max int
+	names    []string
+}
+
+var cronFields = []cronField{
+	{0, 59, nil},
+	{0, 23, nil},
+	{1, 31, nil},
+	{1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a cron expression, such as `30 2 * * mon-fri` or `@daily`.
+func ParseCron(expr string) (*CronSchedule, error) {
+	if shortcut, ok := cronShortcuts[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		expr = shortcut
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression '%s': expected 5 fields", expr)
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		var err error
+		bits[i], err = cronFields[i].parse(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression '%s': %v", expr, err)
+		}
+	}
+	// Sunday can be written as either 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return &CronSchedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parse turns a field such as `1,5-10,*/15` into a set of bits.
+func (field cronField) parse(value string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(value, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in '%s'", part)
+			}
+			part = part[:i]
+		}
+
+		low, high := field.min, field.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			low, err = field.value(bounds[0])
+			if err != nil {
+				return 0, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				high, err = field.value(bounds[1])
+				if err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// `5/15` means every 15 starting at 5
+				high = field.max
+			}
+			if high < low {
+				return 0, fmt.Errorf("invalid range '%s'", part)
+			}
+		}
+
+		for n := low; n <= high; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+func (field cronField) value(value string) (int, error) {
+	for i, name := range field.names {
+		if strings.EqualFold(value, name) {
+			return i + field.min, nil
+		}
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < field.min || n > field.max {
+		return 0, fmt.Errorf("'%s' is out of range", value)
+	}
+	return n, nil
+}
+
+// Matches reports whether the schedule runs at the minute of t.
+func (cron *CronSchedule) Matches(t time.Time) bool {
+	return cron.month&(1<<uint(t.Month())) != 0 && cron.matchesDay(t) &&
+		cron.hour&(1<<uint(t.Hour())) != 0 && cron.minute&(1<<uint(t.Minute())) != 0
+}
+
+func (cron *CronSchedule) matchesDay(t time.Time) bool {
+	domMatch := cron.dom&(1<<uint(t.Day())) != 0
+	dowMatch := cron.dow&(1<<uint(t.Weekday())) != 0
+	if cron.domStar || cron.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the first minute after t at which the schedule runs, or the
+// zero time if there is none within the next few years.
+func (cron *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case cron.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !cron.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case cron.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case cron.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
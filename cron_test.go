@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		valid   bool
+		matches []string
+		misses  []string
+	}{
+		{"* * * * *", true, []string{"2024-03-05 10:17"}, nil},
+		{"30 2 * * *", true, []string{"2024-03-05 02:30"}, []string{"2024-03-05 02:31", "2024-03-05 03:30"}},
+		{"*/15 * * * *", true, []string{"2024-03-05 10:00", "2024-03-05 10:45"}, []string{"2024-03-05 10:20"}},
+		{"5/20 * * * *", true, []string{"2024-03-05 10:05", "2024-03-05 10:45"}, []string{"2024-03-05 10:00"}},
+		{"0 9-17/4 * * *", true, []string{"2024-03-05 09:00", "2024-03-05 17:00"}, []string{"2024-03-05 11:00"}},
+		{"0 0 1,15 * *", true, []string{"2024-03-01 00:00", "2024-03-15 00:00"}, []string{"2024-03-02 00:00"}},
+		{"0 0 * jan,Dec *", true, []string{"2024-01-10 00:00", "2024-12-10 00:00"}, []string{"2024-06-10 00:00"}},
+		{"0 0 * * mon-fri", true, []string{"2024-03-04 00:00", "2024-03-08 00:00"}, []string{"2024-03-09 00:00"}},
+		{"0 0 * * 7", true, []string{"2024-03-10 00:00"}, []string{"2024-03-11 00:00"}},
+		{"0 0 * * 0", true, []string{"2024-03-10 00:00"}, nil},
+		{"@daily", true, []string{"2024-03-05 00:00"}, []string{"2024-03-05 00:01"}},
+		{"@Weekly", true, []string{"2024-03-10 00:00"}, []string{"2024-03-11 00:00"}},
+		{"@yearly", true, []string{"2024-01-01 00:00"}, []string{"2024-02-01 00:00"}},
+
+		// with both day fields restricted, either of them is enough
+		{"0 0 13 * fri", true, []string{"2024-03-13 00:00", "2024-03-15 00:00", "2024-09-13 00:00"}, []string{"2024-03-14 00:00"}},
+		// with either day field starting with *, both have to match
+		{"0 0 */2 * fri", true, []string{"2024-03-01 00:00", "2024-03-15 00:00"}, []string{"2024-03-08 00:00", "2024-03-13 00:00"}},
+		{"0 0 13 * *", true, []string{"2024-03-13 00:00"}, []string{"2024-03-15 00:00"}},
+
+		{"", false, nil, nil},
+		{"* * * *", false, nil, nil},
+		{"* * * * * *", false, nil, nil},
+		{"60 * * * *", false, nil, nil},
+		{"* 24 * * *", false, nil, nil},
+		{"* * 0 * *", false, nil, nil},
+		{"* * * 13 *", false, nil, nil},
+		{"* * * * 8", false, nil, nil},
+		{"*/0 * * * *", false, nil, nil},
+		{"10-5 * * * *", false, nil, nil},
+		{"* * * foo *", false, nil, nil},
+		{"@sometimes", false, nil, nil},
+	}
+	for _, test := range tests {
+		cron, err := ParseCron(test.expr)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("ParseCron(%q) succeeded, expected an error", test.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCron(%q): %v", test.expr, err)
+			continue
+		}
+		for _, value := range test.matches {
+			if !cron.Matches(parseMinute(t, value)) {
+				t.Errorf("%q doesn't match %s", test.expr, value)
+			}
+		}
+		for _, value := range test.misses {
+			if cron.Matches(parseMinute(t, value)) {
+				t.Errorf("%q matches %s", test.expr, value)
+			}
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr, from, next string
+	}{
+		{"* * * * *", "2024-03-05 10:17", "2024-03-05 10:18"},
+		{"30 2 * * *", "2024-03-05 02:29", "2024-03-05 02:30"},
+		{"30 2 * * *", "2024-03-05 02:30", "2024-03-06 02:30"},
+		{"0 * * * *", "2024-03-05 23:59", "2024-03-06 00:00"},
+		{"0 0 1 * *", "2024-12-15 08:00", "2025-01-01 00:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 31 * *", "2024-04-01 00:00", "2024-05-31 00:00"},
+		{"0 9 * * mon-fri", "2024-03-08 10:00", "2024-03-11 09:00"},
+		{"0 0 13 * fri", "2024-03-01 00:00", "2024-03-08 00:00"},
+		{"0 0 13 * fri", "2024-03-12 00:00", "2024-03-13 00:00"},
+		{"0 0 */2 * fri", "2024-03-02 00:00", "2024-03-15 00:00"},
+		{"@monthly", "2024-03-05 10:00", "2024-04-01 00:00"},
+		{"0 0 30 2 *", "2024-03-05 10:00", ""},
+	}
+	for _, test := range tests {
+		cron, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %v", test.expr, err)
+			continue
+		}
+		next := cron.Next(parseMinute(t, test.from))
+		if test.next == "" {
+			if !next.IsZero() {
+				t.Errorf("Next(%q, %s) = %s, expected none", test.expr, test.from, next.Format(minuteLayout))
+			}
+			continue
+		}
+		if expected := parseMinute(t, test.next); !next.Equal(expected) {
+			t.Errorf("Next(%q, %s) = %s, expected %s", test.expr, test.from, next.Format(minuteLayout), test.next)
+		}
+	}
+}
+
+const minuteLayout = "2006-01-02 15:04"
+
+func parseMinute(t *testing.T, value string) time.Time {
+	parsed, err := time.Parse(minuteLayout, value)
+	if err != nil {
+		t.Fatalf("invalid time %q: %v", value, err)
+	}
+	return parsed
+}
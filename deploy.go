@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DeployEntry describes a single file or directory to copy out of the build
+// directory.
+type DeployEntry struct {
+	Source  string
+	Dest    string
+	Mode    string
+	Owner   string
+	Exclude []string
+	Delete  bool
+}
+
+// DeployList is the ordered list of entries in the `deploy` section.  It can
+// be written either as a list of entries or, for simple deployments, as a
+// mapping of source to destination.
+type DeployList []DeployEntry
+
+func (list *DeployList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	if _, isList := raw.([]interface{}); !isList {
+		var pairs yaml.MapSlice
+		if err := unmarshal(&pairs); err != nil {
+			return err
+		}
+		entries := make(DeployList, 0, len(pairs))
+		for _, pair := range pairs {
+			source, ok := pair.Key.(string)
+			if !ok {
+				return fmt.Errorf("deploy source must be a string, got %v", pair.Key)
+			}
+			dest, ok := pair.Value.(string)
+			if !ok {
+				return fmt.Errorf("deploy destination for '%s' must be a string", source)
+			}
+			entries = append(entries, DeployEntry{Source: source, Dest: dest})
+		}
+		*list = entries
+		return nil
+	}
+
+	var entries []DeployEntry
+	if err := unmarshal(&entries); err != nil {
+		return err
+	}
+	*list = entries
+	return nil
+}
+
+// FileMode returns the mode to give copied files, or 0 if the source
+// permissions should be kept.
+func (entry DeployEntry) FileMode() (os.FileMode, error) {
+	if entry.Mode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(entry.Mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode '%s'", entry.Mode)
+	}
+	return os.FileMode(mode).Perm(), nil
+}
+
+// Ownership resolves the entry's `user[:group]` owner to numeric ids.  Both
+// ids are -1 if no owner was given.
+func (entry DeployEntry) Ownership() (uid, gid int, err error) {
+	if entry.Owner == "" {
+		return -1, -1, nil
+	}
+	return parseOwner(entry.Owner)
+}
+
+// Excludes reports whether a path relative to the entry's source matches one
+// of its exclude patterns.
+func (entry DeployEntry) Excludes(rel string) bool {
+	base := filepath.Base(rel)
+	for _, pattern := range entry.Exclude {
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CopyEntry copies source to dest according to the options in entry.  When
+// entry.Delete is set, files in dest that do not exist in source are removed
+// afterwards, except for those matching an exclude pattern.
+func CopyEntry(entry DeployEntry, source, dest string) error {
+	mode, err := entry.FileMode()
+	if err != nil {
+		return err
+	}
+	uid, gid, err := entry.Ownership()
+	if err != nil {
+		return err
+	}
+
+	copied := make(map[string]bool)
+	walk := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && entry.Excludes(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		destPath := filepath.Join(dest, rel)
+		copied[destPath] = true
+
+		switch {
+		case info.IsDir():
+			err = makeDir(destPath, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			// links are copied as links, and never followed
+			err = copySymlink(path, destPath)
+		case info.Mode().IsRegular():
+			perms := info.Mode().Perm()
+			if mode != 0 {
+				perms = mode
+			}
+			err = copyFile(path, destPath, perms)
+		default:
+			err = fmt.Errorf("'%s' is not a regular file, directory or link", path)
+		}
+		if err == nil && uid >= 0 {
+			err = os.Lchown(destPath, uid, gid)
+		}
+		return err
+	}
+	err = filepath.Walk(source, walk)
+	if err != nil {
+		return err
+	}
+
+	if entry.Delete {
+		return deleteExtraneous(entry, dest, copied)
+	}
+	return nil
+}
+
+func deleteExtraneous(entry DeployEntry, dest string, keep map[string]bool) error {
+	info, err := os.Stat(dest)
+	if err != nil || !info.IsDir() {
+		return err
+	}
+
+	walk := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if keep[path] {
+			return nil
+		}
+		rel, err := filepath.Rel(dest, path)
+		if err != nil {
+			return err
+		}
+		if entry.Excludes(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		err = os.RemoveAll(path)
+		if err == nil && info.IsDir() {
+			return filepath.SkipDir
+		}
+		return err
+	}
+	return filepath.Walk(dest, walk)
+}
+
+// resolveSource follows the links in the path of a deploy source, which has
+// to end up inside the build directory.  The build directory belongs to the
+// build user while files are deployed as root, so a link must not make root
+// copy out files that the build couldn't read.
+func resolveSource(build, source string) (string, error) {
+	root, err := filepath.EvalSymlinks(build)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' is outside the build directory", source)
+	}
+	return resolved, nil
+}
+
+// makeDir creates a directory, replacing anything else in its place, so that
+// files are never written through a link left by an earlier deploy.
+func makeDir(path string, perms os.FileMode) error {
+	if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(path, perms)
+}
+
+// removeNonDir removes whatever is at path unless it is a directory or a
+// regular file, which are written over.
+func removeNonDir(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.IsDir() || info.Mode().IsRegular() {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+func copySymlink(source, dest string) error {
+	target, err := os.Readlink(source)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Lstat(dest); err == nil && !info.IsDir() {
+		if err = os.Remove(dest); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(target, dest)
+}
+
+func copyFile(source, dest string, perms os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err == nil {
+		err = removeNonDir(dest)
+	}
+	if err != nil {
+		return err
+	}
+
+	// neither end is followed if it has been swapped for a link
+	read, err := os.OpenFile(source, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer read.Close()
+
+	write, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, perms)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(write, read)
+	if err == nil {
+		err = write.Chmod(perms)
+	}
+	if closeErr := write.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// parseOwner resolves a `user[:group]` string to numeric ids.  The group
+// defaults to the user's primary group, or -1 if the user is only known by
+// its id.
+func parseOwner(owner string) (uid, gid int, err error) {
+	parts := strings.SplitN(owner, ":", 2)
+	uid, gid, err = lookupUser(parts[0])
+	if err == nil && len(parts) == 2 {
+		gid, err = lookupGroup(parts[1])
+	}
+	return
+}
+
+func lookupUser(name string) (uid, gid int, err error) {
+	if id, convErr := strconv.Atoi(name); convErr == nil {
+		// numeric ids don't need to exist in the password database
+		if u, lookupErr := user.LookupId(name); lookupErr == nil {
+			gid, err = strconv.Atoi(u.Gid)
+			return id, gid, err
+		}
+		return id, -1, nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return
+	}
+	uid, err = strconv.Atoi(u.Uid)
+	if err == nil {
+		gid, err = strconv.Atoi(u.Gid)
+	}
+	return
+}
+
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(group.Gid)
+}
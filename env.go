@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const defaultBuildPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// BaseEnv returns the environment that every build starts from.  It only holds
+// PATH, HOME and LANG, plus any of the server's own variables named in
+// INTEGRAD_PASSTHROUGH, so that builds don't depend on how the server was
+// started.
+func BaseEnv() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "/"
+	}
+	env := []string{
+		"PATH=" + defaultBuildPath,
+		"HOME=" + home,
+		"LANG=C.UTF-8",
+	}
+
+	for _, name := range strings.Split(PASSTHROUGH, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			env = setEnv(env, name, value)
+		}
+	}
+	return env
+}
+
+// EnvVar is a single variable in an EnvList.
+type EnvVar struct {
+	Name  string
+	Value string
+}
+
+// EnvList is an ordered list of environment variables, written as a mapping.
+// Values may refer to variables set before them, such as
+// `$PATH:{{ .Build }}/bin`.
+type EnvList []EnvVar
+
+func (list *EnvList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var pairs yaml.MapSlice
+	if err := unmarshal(&pairs); err != nil {
+		return err
+	}
+
+	vars := make(EnvList, 0, len(pairs))
+	for _, pair := range pairs {
+		name, ok := pair.Key.(string)
+		if !ok {
+			return fmt.Errorf("environment variable name must be a string, got %v", pair.Key)
+		}
+		value := ""
+		if pair.Value != nil {
+			value = fmt.Sprint(pair.Value)
+		}
+		vars = append(vars, EnvVar{Name: name, Value: value})
+	}
+	*list = vars
+	return nil
+}
+
+// Apply returns a copy of env with the list's variables set in order,
+// expanding references to variables that are already set.
+func (list EnvList) Apply(env []string) []string {
+	env = appendEnv(env)
+	for _, v := range list {
+		env = setEnv(env, v.Name, os.Expand(v.Value, mapEnv(env)))
+	}
+	return env
+}
+
+// setEnv sets a variable in env, replacing any existing value.
+func setEnv(env []string, name, value string) []string {
+	prefix := name + "="
+	for i, v := range env {
+		if strings.HasPrefix(v, prefix) {
+			env[i] = prefix + value
+			return env
+		}
+	}
+	return append(env, prefix+value)
+}
+
+func mapEnv(env []string) func(string) string {
+	envMap := make(map[string]string)
+	for _, v := range env {
+		split := strings.SplitN(v, "=", 2)
+		if len(split) == 2 {
+			envMap[split[0]] = split[1]
+		}
+	}
+	return func(key string) string {
+		return envMap[key]
+	}
+}
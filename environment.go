@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Environment is a named target in the `environments` section, such as
+// staging or production.  Its env is applied on top of the top-level env, and
+// its deploy and post sections replace the top-level ones if it has them.
+type Environment struct {
+	Env    EnvList
+	Deploy DeployList
+	Post   []Step
+}
+
+// EnvironmentNames returns the names of the configuration's environments in
+// order.
+func (config Config) EnvironmentNames() []string {
+	names := make([]string, 0, len(config.Environments))
+	for name := range config.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ForEnvironment returns the configuration with the named environment
+// applied.  An empty name leaves the configuration as it is.
+func (config Config) ForEnvironment(name string) (Config, error) {
+	if name == "" {
+		return config, nil
+	}
+	environment, ok := config.Environments[name]
+	if !ok {
+		return config, fmt.Errorf("unknown environment '%s'", name)
+	}
+
+	config.Env = append(append(EnvList{}, config.Env...), environment.Env...)
+	if environment.Deploy != nil {
+		config.Deploy = environment.Deploy
+	}
+	if environment.Post != nil {
+		config.Post = environment.Post
+	}
+	return config, nil
+}
+
+// Deployment records the last successful job of a source in one of its
+// environments.
+type Deployment struct {
+	Source      string
+	Environment string `json:",omitempty"`
+	Job         int
+	Version     string
+	Time        time.Time
+}
+
+const deploymentsBucket = "deployments"
+
+func deploymentKey(source, environment string) []byte {
+	return []byte(source + "\x00" + environment)
+}
+
+// recordDeployment notes that job is the last successful deploy of its source
+// and environment.
+func recordDeployment(tx *bolt.Tx, job Job) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(deploymentsBucket))
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(Deployment{
+		Source:      job.Args["source"],
+		Environment: job.Environment,
+		Job:         job.Number,
+		Version:     job.Args["git"],
+		Time:        job.Updated,
+	})
+	if err != nil {
+		return err
+	}
+	return bucket.Put(deploymentKey(job.Args["source"], job.Environment), buf)
+}
+
+// Deployments returns the last successful deploy of every source and
+// environment, sorted by source and then environment.
+func (queue *JobQueue) Deployments() (deployments []Deployment, err error) {
+	err = queue.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(deploymentsBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var deployment Deployment
+			err := json.Unmarshal(v, &deployment)
+			if err != nil {
+				return err
+			}
+			deployments = append(deployments, deployment)
+			return nil
+		})
+	})
+	return
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kr/text"
+)
+
+// HealthCheck describes how to tell whether a deployment is working after the
+// post commands have run.  Exactly one of Command or URL should be set.
+type HealthCheck struct {
+	Command string
+	URL     string
+	// Retries is how many times a failed check is tried again.  It defaults
+	// to 3, but can be set to 0.
+	Retries  int
+	Interval Duration
+	Timeout  Duration
+	Rollback bool
+}
+
+const (
+	defaultHealthRetries  = 3
+	defaultHealthInterval = 5 * time.Second
+	defaultHealthTimeout  = 10 * time.Second
+)
+
+func (check *HealthCheck) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plainHealthCheck HealthCheck
+	plain := plainHealthCheck{Retries: defaultHealthRetries}
+	if err := unmarshal(&plain); err != nil {
+		return err
+	}
+	*check = HealthCheck(plain)
+	return nil
+}
+
+// Run checks the deployment until it reports healthy or the retries run out.
+func (check HealthCheck) Run(cwd string, env []string, runner Runner, logger *log.Logger) error {
+	retries := check.Retries
+	interval := time.Duration(check.Interval)
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	timeout := time.Duration(check.Timeout)
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+
+	var err error
+	for attempt := 1; attempt <= retries+1; attempt++ {
+		if attempt > 1 {
+			time.Sleep(interval)
+		}
+		logger.Printf("Running health check %d/%d", attempt, retries+1)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if check.URL != "" {
+			err = check.get(ctx)
+		} else {
+			var output string
+			output, err = runner.Run(ctx, cwd, env, SHELL, "-c", check.Command)
+			if trimmed := strings.TrimSpace(output); len(trimmed) > 0 {
+				logger.Println(text.Indent(trimmed, "    "))
+			}
+		}
+		cancel()
+
+		if err == nil {
+			logger.Println("Health check passed.")
+			return nil
+		}
+		logger.Printf("Health check failed: %v", err)
+	}
+	return fmt.Errorf("health check failed: %v", err)
+}
+
+func (check HealthCheck) get(ctx context.Context) error {
+	request, err := http.NewRequest("GET", check.URL, nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 400 {
+		return fmt.Errorf("%s returned %s", check.URL, response.Status)
+	}
+	return nil
+}
+
+// Backup holds copies of deploy destinations as they were before a deploy,
+// so that they can be restored if the deploy turns out to be broken.
+type Backup struct {
+	dir     string
+	entries []backupEntry
+}
+
+type backupEntry struct {
+	dest  string
+	saved string // empty if dest did not exist
+}
+
+func NewBackup(dir string) *Backup {
+	return &Backup{dir: dir}
+}
+
+// Save copies dest into the backup, unless it has already been saved.
+func (backup *Backup) Save(dest string) error {
+	for _, entry := range backup.entries {
+		if entry.dest == dest {
+			return nil
+		}
+	}
+
+	entry := backupEntry{dest: dest}
+	if _, err := os.Lstat(dest); err == nil {
+		entry.saved = filepath.Join(backup.dir, fmt.Sprintf("%d", len(backup.entries)))
+		err = copyPreserving(dest, entry.saved)
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	backup.entries = append(backup.entries, entry)
+	return nil
+}
+
+// Restore puts every saved destination back the way it was, removing those
+// that didn't exist before the deploy.
+func (backup *Backup) Restore() error {
+	for i := len(backup.entries) - 1; i >= 0; i-- {
+		entry := backup.entries[i]
+		var err error
+		if entry.saved == "" {
+			err = os.RemoveAll(entry.dest)
+		} else {
+			err = copyPreserving(entry.saved, entry.dest)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (backup *Backup) Remove() {
+	os.RemoveAll(backup.dir)
+}
+
+// copyPreserving makes dest an exact copy of source, including the owners of
+// all files.
+func copyPreserving(source, dest string) error {
+	err := CopyEntry(DeployEntry{Delete: true}, source, dest)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		destPath := filepath.Join(dest, path[len(source):])
+		return os.Lchown(destPath, int(stat.Uid), int(stat.Gid))
+	})
+}
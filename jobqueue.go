@@ -3,8 +3,12 @@ package main
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,33 +22,202 @@ const (
 	Active
 	Succeeded
 	Failed
+	LimitExceeded
+	Superseded
+	Cancelled
+	AwaitingApproval
 )
 
+var statusNames = []string{
+	"Queued",
+	"Active",
+	"Succeeded",
+	"Failed",
+	"Limit exceeded",
+	"Superseded",
+	"Cancelled",
+	"Awaiting approval",
+}
+
 func (status JobStatus) GetName() string {
-	values := []string{
-		"Queued",
-		"Active",
-		"Succeeded",
-		"Failed",
+	return statusNames[status]
+}
+
+func (status JobStatus) String() string {
+	return status.GetName()
+}
+
+// Statuses are written out by name, so that scripts reading the output of
+// the client don't depend on their order.  Jobs saved before that have them
+// as numbers.
+func (status JobStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(status.GetName())
+}
+
+func (status *JobStatus) UnmarshalJSON(data []byte) error {
+	var number int
+	if err := json.Unmarshal(data, &number); err == nil {
+		*status = JobStatus(number)
+		return nil
+	}
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	for i, statusName := range statusNames {
+		if name == statusName {
+			*status = JobStatus(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown job status '%s'", name)
+}
+
+// StatusForError returns the status of a job or step that ended with err.
+func StatusForError(err error) JobStatus {
+	var limitErr *LimitError
+	switch {
+	case err == nil:
+		return Succeeded
+	case errors.As(err, &limitErr):
+		return LimitExceeded
+	case errors.Is(err, errAwaitingApproval):
+		return AwaitingApproval
+	default:
+		return Failed
+	}
+}
+
+// JobPriority decides which queued job runs first.  Jobs of the same
+// priority run in the order they were queued.
+type JobPriority int
+
+const (
+	Low    JobPriority = -1
+	Normal JobPriority = 0
+	High   JobPriority = 1
+)
+
+func (priority JobPriority) GetName() string {
+	switch priority {
+	case Low:
+		return "low"
+	case Normal:
+		return "normal"
+	case High:
+		return "high"
+	}
+	return strconv.Itoa(int(priority))
+}
+
+// ParsePriority accepts `low`, `normal`, `high` or a number.
+func ParsePriority(name string) (JobPriority, error) {
+	for _, priority := range []JobPriority{Low, Normal, High} {
+		if strings.EqualFold(name, priority.GetName()) {
+			return priority, nil
+		}
 	}
-	return values[status]
+	n, err := strconv.Atoi(name)
+	if err != nil {
+		return Normal, fmt.Errorf("invalid priority '%s'", name)
+	}
+	return JobPriority(n), nil
 }
 
 type Job struct {
-	Number  int
-	Args    map[string]string
-	Status  JobStatus
-	Updated time.Time
+	Number   int
+	Args     map[string]string
+	Status   JobStatus
+	Updated  time.Time
+	Steps    []StepResult
+	Priority JobPriority `json:",omitempty"`
+	// Environment is the environment of the configuration that the job
+	// deploys to, if any.
+	Environment string `json:",omitempty"`
+	// Order places the job among queued jobs of the same priority.  It is the
+	// job's number unless the job has been moved.
+	Order int `json:",omitempty"`
+	// After lists the jobs that have to succeed before this one can start.
+	After []int `json:",omitempty"`
+	// SupersededBy is the newer job that replaced this one while it was
+	// still queued.
+	SupersededBy int `json:",omitempty"`
+	// Parent is the job whose triggers queued this one, and Children are the
+	// jobs queued by this one's triggers.
+	Parent   int   `json:",omitempty"`
+	Children []int `json:",omitempty"`
+	// Triggers are the triggers of the job's configuration, filled in while
+	// the job runs.
+	Triggers []Trigger `json:"-"`
+	// Approval is set once the job has stopped at its approval gate.
+	Approval *Approval `json:",omitempty"`
+}
+
+// coalesceKey identifies the jobs that make each other redundant: those for
+// the same source, ref and environment.  Jobs created without a ref use their
+// version.
+func (job Job) coalesceKey() string {
+	ref, ok := job.Args["ref"]
+	if !ok {
+		ref = job.Args["git"]
+	}
+	return job.Args["source"] + "\x00" + ref + "\x00" + job.Environment
+}
+
+func (job Job) order() int {
+	if job.Order != 0 {
+		return job.Order
+	}
+	return job.Number
+}
+
+// StepResult records the outcome of a single step of a job.
+type StepResult struct {
+	Phase    string
+	Name     string
+	Status   JobStatus
+	Error    string `json:",omitempty"`
+	Duration time.Duration
+	Attempts int `json:",omitempty"`
+	// Cell names the matrix cell that the step ran in, if any.
+	Cell string `json:",omitempty"`
+}
+
+// RecordStep adds the result of a step that started at the given time.
+func (job *Job) RecordStep(phase, name string, started time.Time, err error) {
+	job.RecordAttempts(phase, name, started, 1, err)
+}
+
+// RecordAttempts adds the result of a step that may have been retried.
+func (job *Job) RecordAttempts(phase, name string, started time.Time, attempts int, err error) {
+	job.RecordResult(StepResult{Phase: phase, Name: name, Attempts: attempts}, started, err)
+}
+
+// RecordResult adds result, filling in its status, duration and error.  A
+// step stopped because a parallel step failed is recorded as cancelled; the
+// job itself fails with the step that failed.
+func (job *Job) RecordResult(result StepResult, started time.Time, err error) {
+	result.Status = StatusForError(err)
+	if err == errStepCancelled {
+		result.Status = Cancelled
+	}
+	result.Duration = time.Since(started)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	job.Steps = append(job.Steps, result)
 }
 
 type JobQueue struct {
-	Output chan Job
+	// Coalesce makes new jobs supersede older queued jobs for the same
+	// source and ref, so that only the newest of them runs.
+	Coalesce bool
 
 	name    string
 	db      *bolt.DB
 	current int
-	open    bool
 	notify  chan interface{}
+	closed  chan interface{}
 	wg      sync.WaitGroup
 }
 
@@ -60,52 +233,50 @@ func NewJobQueue(db *bolt.DB, name string) (queue *JobQueue, err error) {
 		return
 	}
 
+	// resume from the first job that hasn't started yet
 	current := 1
 	err = db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(name))
-		jobCount := bucket.Stats().KeyN
-		cursor := bucket.Cursor()
+		cursor := tx.Bucket([]byte(name)).Cursor()
 
-		var job Job
-		queuedCount := 0
-
-		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var job Job
 			err := json.Unmarshal(v, &job)
 			if err != nil {
 				return err
 			}
-			if job.Status != Queued {
+			current = job.Number + 1
+			if job.Status == Queued {
+				current = job.Number
 				break
 			}
-			queuedCount++
 		}
-		current = (jobCount - queuedCount) + 1
 		return nil
 	})
 	if err != nil {
 		return
 	}
 
-	output := make(chan Job)
-	notify := make(chan interface{})
-
 	queue = &JobQueue{
 		name:    name,
 		db:      db,
-		notify:  notify,
+		notify:  make(chan interface{}, 1),
+		closed:  make(chan interface{}),
 		current: current,
-		open:    true,
-		Output:  output,
 	}
-	go queue.readWorker()
-	queue.notifyWorker()
 	return
 }
 
-func (queue *JobQueue) AddJob(args map[string]string) (Job, error) {
+// AddJob queues a new job with the arguments, priority, environment,
+// dependencies and parent of the given one.
+func (queue *JobQueue) AddJob(template Job) (Job, error) {
 	job := Job{
-		Args: args,
+		Args:        template.Args,
+		Priority:    template.Priority,
+		Environment: template.Environment,
+		After:       template.After,
+		Parent:      template.Parent,
 	}
+	var superseded []Job
 	err := queue.db.Batch(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(queue.name))
 
@@ -114,24 +285,70 @@ func (queue *JobQueue) AddJob(args map[string]string) (Job, error) {
 		job.Status = Queued
 		job.Updated = time.Now()
 
+		var err error
+		superseded = nil
+		if queue.Coalesce {
+			superseded, err = supersedeJobs(bucket, job)
+			if err != nil {
+				return err
+			}
+		}
+		// the newest job takes over the place of an urgent job it replaces
+		for _, old := range superseded {
+			if old.Priority > job.Priority {
+				job.Priority = old.Priority
+			}
+		}
+
 		buf, err := json.Marshal(job)
 		if err != nil {
 			return err
 		}
-
 		return bucket.Put(itob(job.Number), buf)
 	})
 	log.Printf("Added job %d", job.Number)
+	for _, old := range superseded {
+		log.Printf("Job %d superseded by job %d", old.Number, job.Number)
+	}
 
 	queue.notifyWorker()
 	return job, err
 }
 
-func (queue *JobQueue) FinishJob(job Job, success bool) {
-	newStatus := Succeeded
-	if !success {
-		newStatus = Failed
+// supersedeJobs marks the queued jobs that job makes redundant as
+// Superseded, returning them.
+func supersedeJobs(bucket *bolt.Bucket, job Job) ([]Job, error) {
+	var superseded []Job
+	key := job.coalesceKey()
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		var queued Job
+		err := json.Unmarshal(v, &queued)
+		if err != nil {
+			return nil, err
+		}
+		// approved jobs have already been built, and only need deploying
+		if queued.Status != Queued || queued.coalesceKey() != key || queued.Approval != nil {
+			continue
+		}
+
+		queued.Status = Superseded
+		queued.SupersededBy = job.Number
+		queued.Updated = job.Updated
+		buf, err := json.Marshal(queued)
+		if err != nil {
+			return nil, err
+		}
+		// the cursor stays valid, since the key already exists
+		if err = bucket.Put(k, buf); err != nil {
+			return nil, err
+		}
+		superseded = append(superseded, queued)
 	}
+	return superseded, nil
+}
+
+func (queue *JobQueue) FinishJob(job Job, newStatus JobStatus) {
 	queue.wg.Add(1)
 	go func() {
 		defer queue.wg.Done()
@@ -139,79 +356,370 @@ func (queue *JobQueue) FinishJob(job Job, success bool) {
 			bucket := tx.Bucket([]byte(queue.name))
 			key := itob(job.Number)
 
+			var stored Job
 			buf := bucket.Get(key)
-			err := json.Unmarshal(buf, &job)
+			err := json.Unmarshal(buf, &stored)
 			if err != nil {
 				return err
 			}
 
-			job.Status = newStatus
-			buf, err = json.Marshal(job)
+			stored.Status = newStatus
+			stored.Steps = job.Steps
+			stored.Children = job.Children
+			stored.Approval = job.Approval
+			stored.Updated = time.Now()
+			buf, err = json.Marshal(stored)
 			if err != nil {
 				return err
 			}
+			if err = bucket.Put(key, buf); err != nil {
+				return err
+			}
 
-			return bucket.Put(key, buf)
+			if newStatus == Succeeded {
+				return recordDeployment(tx, stored)
+			}
+			return nil
 		})
+		// jobs waiting for this one may be able to run now
+		queue.notifyWorker()
 	}()
 }
 
+// Close stops handing out jobs, and waits for finished jobs to be saved.
 func (queue *JobQueue) Close() {
-	queue.open = false
-	close(queue.notify)
+	close(queue.closed)
 	queue.wg.Wait()
 }
 
 func (queue *JobQueue) notifyWorker() {
-	if queue.open {
-		select {
-		case queue.notify <- nil:
-		default:
-		}
+	select {
+	case queue.notify <- nil:
+	default:
 	}
 }
 
-func (queue *JobQueue) readWorker() {
-	defer close(queue.Output)
-
-	var buf []byte
-	var job Job
+// Next waits for the next job to run, highest priority first, and marks it
+// Active.  It returns false once the queue is closed.  Jobs that are no
+// longer queued by the time their turn comes, such as superseded ones, are
+// skipped.
+func (queue *JobQueue) Next() (Job, bool) {
 	for {
+		select {
+		case <-queue.closed:
+			return Job{}, false
+		default:
+		}
+
+		var found, failed bool
+		var job Job
 		err := queue.db.Update(func(tx *bolt.Tx) error {
 			bucket := tx.Bucket([]byte(queue.name))
-			key := itob(queue.current)
-			buf = bucket.Get(key)
-
-			if buf == nil {
+			pending, first, err := pendingJobs(bucket, queue.current)
+			if err != nil {
+				return err
+			}
+			queue.current = first
+			found = len(pending) > 0
+			if !found {
 				return nil
 			}
 
-			err := json.Unmarshal(buf, &job)
-			if err != nil {
-				panic(err)
+			found = false
+			for _, job = range pending {
+				ready, err := checkDependencies(bucket, &job)
+				if err != nil {
+					return err
+				}
+				if job.Status == Failed {
+					// jobs that depend on this one fail too
+					failed = true
+				}
+				if !ready {
+					continue
+				}
+				found = true
+				break
+			}
+			if !found {
+				return nil
 			}
-			job.Status = Active
 
-			buf, err = json.Marshal(job)
+			job.Status = Active
+			buf, err := json.Marshal(job)
 			if err != nil {
-				panic(err)
+				return err
 			}
-			return bucket.Put(key, buf)
+			return bucket.Put(itob(job.Number), buf)
 		})
 		if err != nil {
 			panic(err)
 		}
+		if found {
+			// there may be more jobs for other workers
+			queue.notifyWorker()
+			return job, true
+		}
+		if failed {
+			continue
+		}
+
+		select {
+		case <-queue.notify:
+		case <-queue.closed:
+			return Job{}, false
+		}
+	}
+}
+
+// checkDependencies reports whether the jobs that job depends on have all
+// succeeded.  If any of them didn't, job is failed in their place.
+func checkDependencies(bucket *bolt.Bucket, job *Job) (bool, error) {
+	ready := true
+	for _, number := range job.After {
+		dependency, err := dependencyJob(bucket, number)
+		if err != nil {
+			return false, err
+		}
+
+		switch dependency.Status {
+		case Succeeded:
+			continue
+		case Queued, Active, AwaitingApproval:
+			ready = false
+			continue
+		}
+
+		now := time.Now()
+		reason := fmt.Errorf("job #%d is %s", dependency.Number,
+			strings.ToLower(dependency.Status.GetName()))
+		job.RecordStep("queue", fmt.Sprintf("after #%d", number), now, reason)
+		job.Status = Failed
+		job.Updated = now
+		buf, err := json.Marshal(job)
+		if err != nil {
+			return false, err
+		}
+		log.Printf("Job %d failed: %v", job.Number, reason)
+		return false, bucket.Put(itob(job.Number), buf)
+	}
+	return ready, nil
+}
+
+// getJob looks up a job by its number.
+func getJob(bucket *bolt.Bucket, number int) (job Job, err error) {
+	buf := bucket.Get(itob(number))
+	if buf == nil {
+		return job, notFound("job #%d does not exist", number)
+	}
+	err = json.Unmarshal(buf, &job)
+	return
+}
+
+// dependencyJob looks up a job that another depends on.  Superseded jobs are
+// replaced with the job that superseded them.
+func dependencyJob(bucket *bolt.Bucket, number int) (job Job, err error) {
+	for {
+		buf := bucket.Get(itob(number))
 		if buf == nil {
-			if _, ok := <-queue.notify; ok {
+			return job, notFound("job #%d does not exist", number)
+		}
+		job = Job{}
+		err = json.Unmarshal(buf, &job)
+		if err != nil || job.Status != Superseded {
+			return
+		}
+		number = job.SupersededBy
+	}
+}
+
+// UpstreamJob returns the job of a source that a dependent job should wait
+// for: the newest one that is still queued, running or waiting for approval,
+// or otherwise the newest one that succeeded.
+func (queue *JobQueue) UpstreamJob(source string) (job Job, found bool, err error) {
+	err = queue.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(queue.name)).Cursor()
+		var succeeded *Job
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			var candidate Job
+			err := json.Unmarshal(v, &candidate)
+			if err != nil {
+				return err
+			}
+			if candidate.Args["source"] != source {
 				continue
-			} else {
-				break
 			}
+			switch candidate.Status {
+			case Queued, Active, AwaitingApproval:
+				job, found = candidate, true
+				return nil
+			case Succeeded:
+				if succeeded == nil {
+					succeeded = &candidate
+				}
+			}
+		}
+		if succeeded != nil {
+			job, found = *succeeded, true
+		}
+		return nil
+	})
+	return
+}
+
+// Ancestors returns the chain of jobs whose triggers led to job, starting
+// with its parent.
+func (queue *JobQueue) Ancestors(job Job) (ancestors []Job, err error) {
+	err = queue.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(queue.name))
+		for number := job.Parent; number != 0; number = job.Parent {
+			buf := bucket.Get(itob(number))
+			if buf == nil {
+				return notFound("job #%d does not exist", number)
+			}
+			job = Job{}
+			err := json.Unmarshal(buf, &job)
+			if err != nil {
+				return err
+			}
+			ancestors = append(ancestors, job)
 		}
+		return nil
+	})
+	return
+}
 
-		queue.Output <- job
-		queue.current++
+// Exists reports whether a job has been created.
+func (queue *JobQueue) Exists(number int) (exists bool) {
+	queue.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket([]byte(queue.name)).Get(itob(number)) != nil
+		return nil
+	})
+	return
+}
+
+// pendingJobs returns the queued jobs numbered from onwards, in the order
+// they will run, along with the number of the first of them.
+func pendingJobs(bucket *bolt.Bucket, from int) ([]Job, int, error) {
+	var pending []Job
+	first := from
+	cursor := bucket.Cursor()
+	for k, v := cursor.Seek(itob(from)); k != nil; k, v = cursor.Next() {
+		var job Job
+		err := json.Unmarshal(v, &job)
+		if err != nil {
+			return nil, first, err
+		}
+		if len(pending) == 0 {
+			first = job.Number + 1
+		}
+		if job.Status == Queued {
+			if len(pending) == 0 {
+				first = job.Number
+			}
+			pending = append(pending, job)
+		}
 	}
+
+	sort.SliceStable(pending, func(i, j int) bool {
+		if pending[i].Priority != pending[j].Priority {
+			return pending[i].Priority > pending[j].Priority
+		}
+		return pending[i].order() < pending[j].order()
+	})
+	return pending, first, nil
+}
+
+// Pending returns the queued jobs in the order they will run.
+func (queue *JobQueue) Pending() (pending []Job, err error) {
+	err = queue.db.View(func(tx *bolt.Tx) error {
+		pending, _, err = pendingJobs(tx.Bucket([]byte(queue.name)), 1)
+		return err
+	})
+	return
+}
+
+// Move puts a queued job at the given position of the queue, counting from 1.
+// The job takes on the priority of the jobs around it, so that it stays where
+// it was put.
+func (queue *JobQueue) Move(number, position int) error {
+	return queue.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(queue.name))
+		pending, _, err := pendingJobs(bucket, 1)
+		if err != nil {
+			return err
+		}
+
+		var moved *Job
+		var others []Job
+		for i := range pending {
+			if pending[i].Number == number {
+				moved = &pending[i]
+			} else {
+				others = append(others, pending[i])
+			}
+		}
+		if moved == nil {
+			return fmt.Errorf("job #%d is not queued", number)
+		}
+
+		index := position - 1
+		if index < 0 {
+			index = 0
+		}
+		if index > len(others) {
+			index = len(others)
+		}
+		if index > 0 {
+			moved.Priority = others[index-1].Priority
+		} else if len(others) > 0 {
+			moved.Priority = others[0].Priority
+		}
+		reordered := append(append(append([]Job{}, others[:index]...), *moved), others[index:]...)
+
+		for i, job := range reordered {
+			job.Order = i + 1
+			buf, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(itob(job.Number), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Cancel removes a queued job from the queue.  Jobs that have already started
+// can't be cancelled.
+func (queue *JobQueue) Cancel(number int) error {
+	return queue.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(queue.name))
+		buf := bucket.Get(itob(number))
+		if buf == nil {
+			return notFound("job #%d does not exist", number)
+		}
+		var job Job
+		err := json.Unmarshal(buf, &job)
+		if err != nil {
+			return err
+		}
+		if job.Status != Queued {
+			return fmt.Errorf("job #%d is %s, not queued", number, strings.ToLower(job.Status.GetName()))
+		}
+		if job.Approval != nil {
+			return fmt.Errorf("job #%d has already been approved", number)
+		}
+
+		job.Status = Cancelled
+		job.Updated = time.Now()
+		buf, err = json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(itob(number), buf)
+	})
 }
 
 func itob(v int) []byte {
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// testQueue returns a queue in a temporary database holding the given jobs.
+func testQueue(t *testing.T, jobs []Job) *JobQueue {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "jobs.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	queue, err := NewJobQueue(db, "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("jobs"))
+		for _, job := range jobs {
+			buf, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(itob(job.Number), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue
+}
+
+func TestPendingJobs(t *testing.T) {
+	tests := []struct {
+		name  string
+		jobs  []Job
+		from  int
+		order []int
+		first int
+	}{
+		{
+			name:  "empty",
+			from:  1,
+			first: 1,
+		},
+		{
+			name: "in order of creation",
+			jobs: []Job{
+				{Number: 1, Status: Queued},
+				{Number: 2, Status: Queued},
+				{Number: 3, Status: Queued},
+			},
+			from:  1,
+			order: []int{1, 2, 3},
+			first: 1,
+		},
+		{
+			name: "higher priorities first",
+			jobs: []Job{
+				{Number: 1, Status: Queued, Priority: Low},
+				{Number: 2, Status: Queued},
+				{Number: 3, Status: Queued, Priority: High},
+				{Number: 4, Status: Queued},
+				{Number: 5, Status: Queued, Priority: High},
+			},
+			from:  1,
+			order: []int{3, 5, 2, 4, 1},
+			first: 1,
+		},
+		{
+			name: "moved jobs by their order",
+			jobs: []Job{
+				{Number: 1, Status: Queued},
+				{Number: 2, Status: Queued},
+				{Number: 3, Status: Queued, Order: 1},
+				{Number: 4, Status: Queued, Priority: High, Order: 5},
+			},
+			from:  1,
+			order: []int{4, 1, 3, 2},
+			first: 1,
+		},
+		{
+			name: "only queued jobs",
+			jobs: []Job{
+				{Number: 1, Status: Succeeded},
+				{Number: 2, Status: Active},
+				{Number: 3, Status: Queued},
+				{Number: 4, Status: Superseded, SupersededBy: 6},
+				{Number: 5, Status: Failed},
+				{Number: 6, Status: Queued},
+			},
+			from:  1,
+			order: []int{3, 6},
+			first: 3,
+		},
+		{
+			name: "none queued",
+			jobs: []Job{
+				{Number: 1, Status: Succeeded},
+				{Number: 2, Status: Failed},
+			},
+			from:  1,
+			first: 3,
+		},
+		{
+			name: "from a later job",
+			jobs: []Job{
+				{Number: 1, Status: Queued},
+				{Number: 2, Status: Succeeded},
+				{Number: 3, Status: Queued},
+			},
+			from:  2,
+			order: []int{3},
+			first: 3,
+		},
+	}
+	for _, test := range tests {
+		queue := testQueue(t, test.jobs)
+		var order []int
+		var first int
+		err := queue.db.View(func(tx *bolt.Tx) error {
+			pending, next, err := pendingJobs(tx.Bucket([]byte(queue.name)), test.from)
+			for _, job := range pending {
+				order = append(order, job.Number)
+			}
+			first = next
+			return err
+		})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(order, test.order) || first != test.first {
+			t.Errorf("%s: got %v from #%d, expected %v from #%d", test.name, order, first, test.order, test.first)
+		}
+	}
+}
+
+func TestCheckDependencies(t *testing.T) {
+	jobs := []Job{
+		{Number: 1, Status: Succeeded},
+		{Number: 2, Status: Queued},
+		{Number: 3, Status: Active},
+		{Number: 4, Status: AwaitingApproval},
+		{Number: 5, Status: Failed},
+		{Number: 6, Status: Cancelled},
+		{Number: 7, Status: Superseded, SupersededBy: 8},
+		{Number: 8, Status: Succeeded},
+		{Number: 9, Status: Superseded, SupersededBy: 10},
+		{Number: 10, Status: Queued},
+	}
+	tests := []struct {
+		after  []int
+		ready  bool
+		status JobStatus
+		fails  bool
+	}{
+		{after: nil, ready: true, status: Queued},
+		{after: []int{1}, ready: true, status: Queued},
+		{after: []int{1, 8}, ready: true, status: Queued},
+		{after: []int{2}, ready: false, status: Queued},
+		{after: []int{3}, ready: false, status: Queued},
+		{after: []int{4}, ready: false, status: Queued},
+		{after: []int{1, 2}, ready: false, status: Queued},
+		{after: []int{5}, ready: false, status: Failed},
+		{after: []int{6}, ready: false, status: Failed},
+		{after: []int{2, 5}, ready: false, status: Failed},
+		{after: []int{7}, ready: true, status: Queued},
+		{after: []int{9}, ready: false, status: Queued},
+		{after: []int{99}, fails: true},
+	}
+	for _, test := range tests {
+		queue := testQueue(t, jobs)
+		job := Job{Number: 20, Status: Queued, After: test.after}
+		var ready bool
+		err := queue.db.Update(func(tx *bolt.Tx) error {
+			var err error
+			ready, err = checkDependencies(tx.Bucket([]byte(queue.name)), &job)
+			return err
+		})
+		if test.fails {
+			if err == nil {
+				t.Errorf("after %v: expected an error", test.after)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("after %v: %v", test.after, err)
+			continue
+		}
+		if ready != test.ready || job.Status != test.status {
+			t.Errorf("after %v: ready %v and %s, expected %v and %s", test.after, ready, job.Status, test.ready, test.status)
+		}
+		if job.Status == Failed && !queue.Exists(job.Number) {
+			t.Errorf("after %v: failed job wasn't saved", test.after)
+		}
+	}
+}
+
+func TestUpstreamJob(t *testing.T) {
+	source := func(number int, name string, status JobStatus) Job {
+		return Job{Number: number, Status: status, Args: map[string]string{"source": name}}
+	}
+	tests := []struct {
+		name   string
+		jobs   []Job
+		number int
+	}{
+		{
+			name: "never deployed",
+			jobs: []Job{source(1, "/other", Succeeded)},
+		},
+		{
+			name: "never succeeded",
+			jobs: []Job{source(1, "/src", Failed), source(2, "/src", Cancelled)},
+		},
+		{
+			name:   "last success after a failure",
+			jobs:   []Job{source(1, "/src", Succeeded), source(2, "/src", Succeeded), source(3, "/src", Failed)},
+			number: 2,
+		},
+		{
+			name:   "running job over a success",
+			jobs:   []Job{source(1, "/src", Succeeded), source(2, "/src", Active), source(3, "/other", Queued)},
+			number: 2,
+		},
+		{
+			name:   "newest job in flight",
+			jobs:   []Job{source(1, "/src", Queued), source(2, "/src", AwaitingApproval), source(3, "/src", Failed)},
+			number: 2,
+		},
+		{
+			name:   "queued job without a success",
+			jobs:   []Job{source(1, "/src", Failed), source(2, "/src", Queued)},
+			number: 2,
+		},
+	}
+	for _, test := range tests {
+		queue := testQueue(t, test.jobs)
+		job, found, err := queue.UpstreamJob("/src")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if found != (test.number != 0) || job.Number != test.number {
+			t.Errorf("%s: got #%d (found %v), expected #%d", test.name, job.Number, found, test.number)
+		}
+	}
+}
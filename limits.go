@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits are the resource limits of the build commands of a job, taken
+// together.  Zero values mean no limit.
+type Limits struct {
+	// CPU is the CPU time the build commands may use between them.
+	CPU Duration
+	// Memory is the memory the build commands may use at once.
+	Memory Size
+	// Processes is the number of processes the build may run at once.
+	Processes int
+	// Output is how much the source and build directories may hold.
+	Output Size
+}
+
+// ServerLimits reads the server-wide limits from INTEGRAD_LIMIT_CPU,
+// INTEGRAD_LIMIT_MEMORY, INTEGRAD_LIMIT_PROCESSES and INTEGRAD_LIMIT_OUTPUT.
+func ServerLimits() (limits Limits, err error) {
+	if LIMIT_CPU != "" {
+		var cpu time.Duration
+		cpu, err = time.ParseDuration(LIMIT_CPU)
+		if err != nil {
+			return limits, fmt.Errorf("invalid CPU limit '%s'", LIMIT_CPU)
+		}
+		limits.CPU = Duration(cpu)
+	}
+	if LIMIT_MEMORY != "" {
+		limits.Memory, err = ParseSize(LIMIT_MEMORY)
+		if err != nil {
+			return
+		}
+	}
+	if LIMIT_PROCESSES != "" {
+		limits.Processes, err = strconv.Atoi(LIMIT_PROCESSES)
+		if err != nil {
+			return limits, fmt.Errorf("invalid process limit '%s'", LIMIT_PROCESSES)
+		}
+	}
+	if LIMIT_OUTPUT != "" {
+		limits.Output, err = ParseSize(LIMIT_OUTPUT)
+	}
+	return
+}
+
+// Merge returns the stricter of each pair of limits.  Projects can lower the
+// server's limits, but not raise them.
+func (limits Limits) Merge(other Limits) Limits {
+	if other.CPU > 0 && (limits.CPU == 0 || other.CPU < limits.CPU) {
+		limits.CPU = other.CPU
+	}
+	if other.Memory > 0 && (limits.Memory == 0 || other.Memory < limits.Memory) {
+		limits.Memory = other.Memory
+	}
+	if other.Processes > 0 && (limits.Processes == 0 || other.Processes < limits.Processes) {
+		limits.Processes = other.Processes
+	}
+	if other.Output > 0 && (limits.Output == 0 || other.Output < limits.Output) {
+		limits.Output = other.Output
+	}
+	return limits
+}
+
+// JobLimits enforces a job's limits across all of its build commands, whether
+// they run one after another or side by side in a parallel group.  Every
+// build command of the job is placed in a single cgroup, which limits their
+// memory and processes together and counts their CPU time.  Without cgroups,
+// the CPU time of each command is added up as it finishes, and memory and
+// processes fall back to rlimits on each command.
+type JobLimits struct {
+	Limits
+	group *cgroup
+	stop  chan struct{}
+
+	mutex sync.Mutex
+	// cpu is the CPU time of the commands that have finished, when there is
+	// no cgroup to count it
+	cpu time.Duration
+	// cpuExceeded is set once the cgroup has been killed for using up the
+	// CPU time
+	cpuExceeded bool
+}
+
+// NewJobLimits sets up the limits of a job.  They have to be closed once the
+// job's commands have finished.
+func NewJobLimits(limits Limits) *JobLimits {
+	job := &JobLimits{Limits: limits, stop: make(chan struct{})}
+	if limits.CPU > 0 || limits.Memory > 0 || limits.Processes > 0 {
+		// without cgroups, rlimits are used instead
+		if group, err := newCgroup(limits); err == nil {
+			job.group = group
+			if limits.CPU > 0 {
+				go job.watchCPU()
+			}
+		}
+	}
+	return job
+}
+
+// Close kills anything the job's commands left running.
+func (job *JobLimits) Close() {
+	close(job.stop)
+	if job.group != nil {
+		job.group.remove()
+	}
+}
+
+// watchCPU kills the job's commands once they have used up its CPU time
+// between them.
+func (job *JobLimits) watchCPU() {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-job.stop:
+			return
+		}
+		if job.group.cpuUsage() >= time.Duration(job.CPU) {
+			job.mutex.Lock()
+			job.cpuExceeded = true
+			job.mutex.Unlock()
+			job.group.kill()
+		}
+	}
+}
+
+// cpuUsed returns the CPU time that the job's commands have used so far.
+func (job *JobLimits) cpuUsed() time.Duration {
+	if job.group != nil {
+		return job.group.cpuUsage()
+	}
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	return job.cpu
+}
+
+func (job *JobLimits) cpuError() error {
+	return &LimitError{Resource: "CPU", Limit: time.Duration(job.CPU).String()}
+}
+
+// commandLimits returns the limits for the job's next command, which may only
+// use the CPU time that is left.
+func (job *JobLimits) commandLimits() (Limits, error) {
+	limits := job.Limits
+	if limits.CPU > 0 {
+		left := time.Duration(limits.CPU) - job.cpuUsed()
+		if left <= 0 {
+			return limits, job.cpuError()
+		}
+		limits.CPU = Duration(left)
+	}
+	return limits, nil
+}
+
+// finished counts the CPU time of a command that ended with err, and returns
+// the limit it ran into, if any.  exceeded is the limit that the command
+// itself was found to have gone over.
+func (job *JobLimits) finished(state *os.ProcessState, err, exceeded error) error {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	if job.group == nil && state != nil {
+		job.cpu += state.UserTime() + state.SystemTime()
+	}
+
+	// a command only knows about the CPU time that was left to it
+	var limitErr *LimitError
+	if errors.As(exceeded, &limitErr) && limitErr.Resource == "CPU" {
+		return job.cpuError()
+	}
+	if exceeded == nil && err != nil && job.cpuExceeded {
+		return job.cpuError()
+	}
+	// rlimits only count whole seconds of each process, so a command can
+	// get past the job's CPU time without being stopped
+	if exceeded == nil && job.group == nil && job.CPU > 0 && job.cpu > time.Duration(job.CPU) {
+		return job.cpuError()
+	}
+	return exceeded
+}
+
+// LimitError is returned when a command is stopped for going over one of its
+// limits.
+type LimitError struct {
+	Resource string
+	Limit    string
+}
+
+func (err *LimitError) Error() string {
+	return fmt.Sprintf("%s limit of %s exceeded", err.Resource, err.Limit)
+}
+
+// Size is a number of bytes, written in the configuration either as a plain
+// number or with a K, M, G or T suffix.
+type Size int64
+
+var sizeUnits = []struct {
+	suffix string
+	size   Size
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+func ParseSize(value string) (Size, error) {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	number = strings.TrimSuffix(number, "B")
+	unit := Size(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(number, u.suffix) {
+			number = strings.TrimSuffix(number, u.suffix)
+			unit = u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+	return Size(n) * unit, nil
+}
+
+func (size Size) String() string {
+	for _, u := range sizeUnits {
+		if size >= u.size && size%u.size == 0 {
+			return fmt.Sprintf("%d%s", size/u.size, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%d", int64(size))
+}
+
+func (size *Size) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	parsed, err := ParseSize(value)
+	if err != nil {
+		return err
+	}
+	*size = parsed
+	return nil
+}
@@ -0,0 +1,214 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// the cgroup v2 group that each limited job gets a child group in
+const cgroupRoot = "/sys/fs/cgroup/integrad"
+
+// cgroup is a cgroup v2 group that holds the build commands of a job, along
+// with every process they start, enforcing their memory and process limits.
+type cgroup struct {
+	path string
+	file *os.File
+}
+
+func newCgroup(limits Limits) (*cgroup, error) {
+	const CGROUP2_SUPER_MAGIC = 0x63677270
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(filepath.Dir(cgroupRoot), &stat)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Type != CGROUP2_SUPER_MAGIC {
+		return nil, fmt.Errorf("%s is not a cgroup v2 hierarchy", filepath.Dir(cgroupRoot))
+	}
+
+	err = os.MkdirAll(cgroupRoot, 0755)
+	if err != nil {
+		return nil, err
+	}
+	// controllers have to be enabled in the parent before child groups can
+	// use them
+	err = writeCgroupFile(filepath.Dir(cgroupRoot), "cgroup.subtree_control", "+memory +pids")
+	if err == nil {
+		err = writeCgroupFile(cgroupRoot, "cgroup.subtree_control", "+memory +pids")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := ioutil.TempDir(cgroupRoot, "job-")
+	if err != nil {
+		return nil, err
+	}
+	group := &cgroup{path: path}
+	if limits.Memory > 0 {
+		err = writeCgroupFile(path, "memory.max", strconv.FormatInt(int64(limits.Memory), 10))
+		if err == nil {
+			// swap would let the command get around the limit
+			writeCgroupFile(path, "memory.swap.max", "0")
+		}
+	}
+	if err == nil && limits.Processes > 0 {
+		err = writeCgroupFile(path, "pids.max", strconv.Itoa(limits.Processes))
+	}
+	if err == nil {
+		group.file, err = os.Open(path)
+	}
+	if err != nil {
+		group.remove()
+		return nil, err
+	}
+	return group, nil
+}
+
+func (group *cgroup) fd() int {
+	return int(group.file.Fd())
+}
+
+// cgroupEvents are the counts of the times a group ran into its limits.
+type cgroupEvents struct {
+	oomKills  int
+	pidsLimit int
+}
+
+func (group *cgroup) events() cgroupEvents {
+	return cgroupEvents{
+		oomKills:  cgroupEvent(group.path, "memory.events", "oom_kill"),
+		pidsLimit: cgroupEvent(group.path, "pids.events", "max"),
+	}
+}
+
+// exceeded reports which of the group's limits were run into since before
+// was counted, if any.
+func (group *cgroup) exceeded(limits Limits, before cgroupEvents) error {
+	after := group.events()
+	if limits.Memory > 0 && after.oomKills > before.oomKills {
+		return &LimitError{Resource: "memory", Limit: limits.Memory.String()}
+	}
+	if limits.Processes > 0 && after.pidsLimit > before.pidsLimit {
+		return &LimitError{Resource: "process", Limit: strconv.Itoa(limits.Processes)}
+	}
+	return nil
+}
+
+// cpuUsage returns the CPU time used by every process that has been in the
+// group.
+func (group *cgroup) cpuUsage() time.Duration {
+	return time.Duration(cgroupEvent(group.path, "cpu.stat", "usage_usec")) * time.Microsecond
+}
+
+// kill kills every process in the group.
+func (group *cgroup) kill() {
+	writeCgroupFile(group.path, "cgroup.kill", "1")
+}
+
+// remove kills anything still left in the group and then deletes it.
+func (group *cgroup) remove() {
+	if group.file != nil {
+		group.file.Close()
+	}
+	group.kill()
+	// the group can only be removed once the kernel has reaped its processes
+	for i := 0; i < 100; i++ {
+		if err := os.Remove(group.path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		syscall.Nanosleep(&syscall.Timespec{Nsec: 10000000}, nil)
+	}
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	return ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+}
+
+// cgroupEvent reads a counter from one of a group's event or stat files.
+func cgroupEvent(dir, name, key string) int {
+	contents, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+	return 0
+}
+
+var rlimitResources = map[string]int{
+	"cpu":   syscall.RLIMIT_CPU,
+	"as":    syscall.RLIMIT_AS,
+	"nproc": 6, // RLIMIT_NPROC
+	"fsize": syscall.RLIMIT_FSIZE,
+}
+
+// rlimitArgs returns the wrapper options that apply the limits which aren't
+// already enforced by a cgroup.
+func rlimitArgs(limits Limits, cgrouped bool) []string {
+	var args []string
+	if limits.CPU > 0 {
+		// rlimits count whole seconds
+		seconds := int64((time.Duration(limits.CPU) + time.Second - 1) / time.Second)
+		args = append(args, "--rlimit", fmt.Sprintf("cpu=%d", seconds))
+	}
+	if !cgrouped && limits.Memory > 0 {
+		args = append(args, "--rlimit", fmt.Sprintf("as=%d", int64(limits.Memory)))
+	}
+	if !cgrouped && limits.Processes > 0 {
+		args = append(args, "--rlimit", fmt.Sprintf("nproc=%d", limits.Processes))
+	}
+	if limits.Output > 0 {
+		// no single file can be bigger than the whole workspace may be.  The
+		// extra byte makes sure the output check still catches a write that
+		// was cut short by the limit.
+		args = append(args, "--rlimit", fmt.Sprintf("fsize=%d", int64(limits.Output)+1))
+	}
+	return args
+}
+
+// signalledLimit recognises a command that was killed for going over one of
+// its rlimits, either directly or as the exit status of a shell.
+func signalledLimit(err error, limits Limits) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return nil
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return nil
+	}
+	var signal syscall.Signal
+	switch {
+	case status.Signaled():
+		signal = status.Signal()
+	case status.ExitStatus() > 128:
+		signal = syscall.Signal(status.ExitStatus() - 128)
+	}
+
+	switch {
+	case signal == syscall.SIGXCPU && limits.CPU > 0:
+		return &LimitError{Resource: "CPU", Limit: time.Duration(limits.CPU).String()}
+	case signal == syscall.SIGKILL && limits.CPU > 0 && exitErr.ProcessState.UserTime()+exitErr.ProcessState.SystemTime() >= time.Duration(limits.CPU):
+		return &LimitError{Resource: "CPU", Limit: time.Duration(limits.CPU).String()}
+	case signal == syscall.SIGXFSZ && limits.Output > 0:
+		return &LimitError{Resource: "output", Limit: limits.Output.String()}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// configLines maps the paths of the keys and list items in a YAML document,
+// such as "build.2" or "environments.prod.deploy", to the lines they start
+// on.  Children are also recorded by position, so that the entries of
+// sections that can be written either as a list or as a mapping, like
+// deploy, can be found by index.
+//
+// yaml.v2 doesn't report positions for decoded values, so the document is
+// scanned by indentation.  Only block style is understood; flow collections
+// and multi-line scalars are skipped over, and their contents are located at
+// the key that holds them.
+type configLines map[string]int
+
+// lineFrame is a key or list item whose children are still being read.
+type lineFrame struct {
+	indent   int
+	path     string
+	children int
+	isKey    bool
+}
+
+func joinPath(parent, child string) string {
+	if parent == "" {
+		return child
+	}
+	return parent + "." + child
+}
+
+// indexLines scans source for the lines of its keys and list items.
+func indexLines(source []byte) configLines {
+	lines := make(configLines)
+	stack := []*lineFrame{{indent: -1}}
+	blockIndent := -1
+
+	// child records a key or list item under the frame it belongs to, and
+	// makes it the frame for the lines below it.
+	child := func(number, indent int, key string, isKey bool) {
+		top := stack[len(stack)-1]
+		path := joinPath(top.path, strconv.Itoa(top.children))
+		top.children++
+		record(lines, path, number)
+		if isKey {
+			path = joinPath(top.path, key)
+			record(lines, path, number)
+		}
+		stack = append(stack, &lineFrame{indent: indent, path: path, isKey: isKey})
+	}
+
+	for i, line := range strings.Split(string(source), "\n") {
+		number := i + 1
+		line = strings.TrimRight(line, " \t\r")
+		content := strings.TrimLeft(line, " ")
+		indent := len(line) - len(content)
+		if content == "" {
+			continue
+		}
+		if blockIndent >= 0 {
+			if indent > blockIndent {
+				continue
+			}
+			blockIndent = -1
+		}
+		if strings.HasPrefix(content, "#") || content == "---" {
+			continue
+		}
+
+		for content == "-" || strings.HasPrefix(content, "- ") {
+			for {
+				top := stack[len(stack)-1]
+				if top.indent < indent || (top.indent == indent && top.isKey) {
+					break
+				}
+				stack = stack[:len(stack)-1]
+			}
+			child(number, indent, "", false)
+			rest := strings.TrimLeft(strings.TrimPrefix(content, "-"), " ")
+			indent += len(content) - len(rest)
+			content = rest
+		}
+
+		key, value, ok := splitKey(content)
+		if !ok {
+			continue
+		}
+		for stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		child(number, indent, key, true)
+		if strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">") {
+			blockIndent = indent
+		}
+	}
+	return lines
+}
+
+// record keeps the first line found for path, so that a repeated key is
+// located where it first appears.
+func record(lines configLines, path string, number int) {
+	if _, ok := lines[path]; !ok {
+		lines[path] = number
+	}
+}
+
+// splitKey splits a "key: value" line into its key and value.
+func splitKey(content string) (key, value string, ok bool) {
+	if content == "" || strings.HasPrefix(content, "{") || strings.HasPrefix(content, "[") {
+		return "", "", false
+	}
+	if quote := content[0]; quote == '"' || quote == '\'' {
+		end := strings.IndexByte(content[1:], quote)
+		if end < 0 {
+			return "", "", false
+		}
+		key, content = content[1:end+1], content[end+2:]
+		if !strings.HasPrefix(content, ":") {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(content[1:]), true
+	}
+	if strings.HasSuffix(content, ":") {
+		return content[:len(content)-1], "", true
+	}
+	end := strings.Index(content, ": ")
+	if end < 0 {
+		return "", "", false
+	}
+	return content[:end], strings.TrimSpace(content[end+2:]), true
+}
+
+// find returns the line of path, or of the closest of its parents that was
+// found.
+func (lines configLines) find(path string) (int, bool) {
+	for path != "" {
+		if number, ok := lines[path]; ok {
+			return number, true
+		}
+		end := strings.LastIndexByte(path, '.')
+		if end < 0 {
+			break
+		}
+		path = path[:end]
+	}
+	return 0, false
+}
@@ -0,0 +1,139 @@
+package main
+
+import "testing"
+
+func TestIndexLines(t *testing.T) {
+	source := []byte(`# deploy.yaml
+user: deploy
+build:
+- run: make
+  timeout: 5m
+- parallel:
+    - name: lint
+      run: |
+        make lint
+        timeout: 1s
+    - name: test
+      run: >
+        make
+        test
+- "make docs"
+deploy:
+  dist: /srv/www
+  "quoted key": /srv/quoted
+environments:
+  staging:
+    deploy:
+      - source: dist
+        dest: /srv/staging
+      -
+        source: docs
+    post:
+    - systemctl restart app
+  'prod':
+    env: {A: 1, B: 2}
+after: [/srv/a, /srv/b]
+matrix:
+  GO:
+  - 1.21
+---
+healthcheck:
+  url: http://localhost
+`)
+	tests := []struct {
+		path string
+		line int
+	}{
+		{"user", 2},
+		{"0", 2},
+		{"build", 3},
+		{"build.0", 4},
+		{"build.0.run", 4},
+		{"build.0.timeout", 5},
+		{"build.1", 6},
+		{"build.1.parallel", 6},
+		{"build.1.parallel.0", 7},
+		{"build.1.parallel.0.run", 8},
+		{"build.1.parallel.1", 11},
+		{"build.1.parallel.1.name", 11},
+		{"build.2", 15},
+		// lines inside block scalars aren't keys
+		{"build.1.parallel.0.timeout", 7},
+		{"build.1.parallel.2", 6},
+		// entries of a mapping can also be found by position
+		{"deploy.0", 17},
+		{"deploy.dist", 17},
+		{"deploy.1", 18},
+		{"deploy.quoted key", 18},
+		{"environments.staging.deploy.0", 22},
+		{"environments.staging.deploy.0.dest", 23},
+		{"environments.staging.deploy.1", 24},
+		{"environments.staging.deploy.1.source", 25},
+		{"environments.staging.post.0", 27},
+		{"environments.prod", 28},
+		// flow collections are located at the key that holds them
+		{"environments.prod.env.A", 29},
+		{"after.1", 30},
+		{"matrix.GO.0", 33},
+		{"matrix.0", 32},
+		{"healthcheck.url", 36},
+		{"missing", 0},
+		{"", 0},
+	}
+	lines := indexLines(source)
+	for _, test := range tests {
+		line, ok := lines.find(test.path)
+		if ok != (test.line != 0) || line != test.line {
+			t.Errorf("%q is on line %d (found %v), expected %d", test.path, line, ok, test.line)
+		}
+	}
+}
+
+func TestSplitKey(t *testing.T) {
+	tests := []struct {
+		content, key, value string
+		ok                  bool
+	}{
+		{"run: make", "run", "make", true},
+		{"build:", "build", "", true},
+		{"run: echo a: b", "run", "echo a: b", true},
+		{`"a: b": c`, "a: b", "c", true},
+		{"'key':", "key", "", true},
+		{"url: http://localhost", "url", "http://localhost", true},
+		{"http://localhost", "", "", false},
+		{"make test", "", "", false},
+		{"{a: 1}", "", "", false},
+		{"[a, b]", "", "", false},
+		{`"unterminated: x`, "", "", false},
+		{`"quoted" text`, "", "", false},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		key, value, ok := splitKey(test.content)
+		if key != test.key || value != test.value || ok != test.ok {
+			t.Errorf("splitKey(%q) = %q, %q, %v, expected %q, %q, %v",
+				test.content, key, value, ok, test.key, test.value, test.ok)
+		}
+	}
+}
+
+func TestValidateLines(t *testing.T) {
+	_, err := ParseConfig([]byte(`build:
+- make
+- timeout: -1s
+  run: make test
+deploy:
+  - source: dist
+environments:
+  prod:
+    post:
+    - ""
+`), ValidationBuild)
+	expected := `invalid configuration:
+  line 3: build: build step 2 has a negative timeout
+  line 6: deploy: entry 1 needs both a source and a dest
+  line 10: environments.prod.post: environments.prod.post step 1 has nothing to run`
+	if err == nil || err.Error() != expected {
+		t.Errorf("got %v, expected %s", err, expected)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kr/text"
+)
+
+// LocalOptions changes how a deploy runs for `integrad run`.
+type LocalOptions struct {
+	// NoDeploy stops the run after the build section.
+	NoDeploy bool
+}
+
+// RunLocal runs the deploy.yaml of a working copy without a server.  The
+// working copy is copied to a scratch directory first, so that the build
+// can't change it.  There is no secret store, so secrets are taken from the
+// environment variables they would be set as.  Caches, artifacts and
+// approval gates are skipped.
+func RunLocal(dir, environment string, options LocalOptions, logger *log.Logger) error {
+	workspace, err := ioutil.TempDir("", "integrad-run-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workspace)
+
+	build := BuildConfig{
+		Source: filepath.Join(workspace, "source"),
+		Build:  filepath.Join(workspace, "build"),
+	}
+	if err = os.Mkdir(build.Build, 0755); err != nil {
+		return err
+	}
+	logger.Printf("Copying '%s' to '%s'", dir, build.Source)
+	if _, err = RunCommand(dir, "cp", "-R", dir, build.Source); err != nil {
+		return err
+	}
+
+	secrets := make(map[string]string)
+	if config, err := LoadConfig(build); err == nil {
+		for name, secret := range config.Secrets {
+			if value, ok := os.LookupEnv(name); ok {
+				secrets[secret] = value
+			}
+		}
+	}
+
+	job := &Job{
+		Args:        map[string]string{"source": dir},
+		Environment: environment,
+	}
+	return runDeploy(build, job, secrets, &options, logger)
+}
+
+// DryRun prints the configuration of a working copy as it would be rendered,
+// and the copies its deploy section would make, without running anything.
+func DryRun(dir, environment string, out io.Writer) error {
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "deploy.yaml"))
+	if err != nil {
+		return err
+	}
+	build := BuildConfig{Source: dir, Build: ValidationBuild.Build}
+	rendered, err := RenderConfig(contents, build)
+	if err != nil {
+		return err
+	}
+	config, err := ParseConfig(contents, build)
+	if err == nil {
+		config, err = config.ForEnvironment(environment)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "Rendered deploy.yaml:")
+	fmt.Fprintln(out, text.Indent(strings.TrimRight(string(rendered), "\n"), "    "))
+
+	fmt.Fprintln(out, "\nFile copies:")
+	if len(config.Deploy) == 0 {
+		fmt.Fprintln(out, "    none")
+	}
+	// secrets aren't known, so paths that use them are left incomplete
+	env := setEnv(BaseEnv(), ENV_PREFIX+"ENVIRONMENT", environment)
+	lookup := mapEnv(config.Env.Apply(env))
+	for _, entry := range config.Deploy {
+		source := entry.Source
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(build.Build, source)
+		}
+		fmt.Fprintf(out, "    %s -> %s\n", os.Expand(source, lookup), os.Expand(entry.Dest, lookup))
+
+		var details []string
+		if entry.Mode != "" {
+			details = append(details, "mode "+entry.Mode)
+		}
+		if entry.Owner != "" {
+			details = append(details, "owner "+entry.Owner)
+		}
+		if len(entry.Exclude) > 0 {
+			details = append(details, "excluding "+strings.Join(entry.Exclude, ", "))
+		}
+		if entry.Delete {
+			details = append(details, "deleting extraneous files")
+		}
+		if len(details) > 0 {
+			fmt.Fprintf(out, "        (%s)\n", strings.Join(details, "; "))
+		}
+	}
+	return nil
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"io"
+	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -33,7 +38,8 @@ func NewDbWriter(db *bolt.DB, delay time.Duration, logBucket, jobBucket string)
 		return nil, err
 	}
 
-	go dbWorker(db, delay, logBucket, jobBucket, input)
+	writer.wg.Add(1)
+	go dbWorker(db, delay, logBucket, jobBucket, input, &writer.wg)
 	return &writer, nil
 }
 
@@ -42,14 +48,16 @@ func (writer *DbWriter) Write(data []byte) (int, error) {
 	return len(data), nil
 }
 
+// Close stores what is left to write, and waits until it has been stored.
 func (writer *DbWriter) Close() {
 	close(writer.input)
 	writer.wg.Wait()
 }
 
-func dbWorker(db *bolt.DB, delay time.Duration, logBucket, jobBucket string, input <-chan string) {
+func dbWorker(db *bolt.DB, delay time.Duration, logBucket, jobBucket string, input <-chan string, wg *sync.WaitGroup) {
+	defer wg.Done()
 
-	buffer := make([]string, 64)
+	buffer := make([]string, 0, 64)
 	open := true
 	ticker := time.NewTicker(delay)
 	defer ticker.Stop()
@@ -69,15 +77,16 @@ func dbWorker(db *bolt.DB, delay time.Duration, logBucket, jobBucket string, inp
 				reading = false
 			}
 		}
+		if len(buffer) == 0 {
+			continue
+		}
 		err := db.Batch(func(tx *bolt.Tx) error {
 			lb := tx.Bucket([]byte(logBucket))
 			jb := lb.Bucket([]byte(jobBucket))
 
-			bid, _ := jb.NextSequence()
-			id := int(bid)
-
-			for i, msg := range buffer {
-				err := jb.Put(itob(id+i), []byte(msg))
+			for _, msg := range buffer {
+				id, _ := jb.NextSequence()
+				err := jb.Put(itob(int(id)), []byte(msg))
 				if err != nil {
 					return err
 				}
@@ -88,5 +97,87 @@ func dbWorker(db *bolt.DB, delay time.Duration, logBucket, jobBucket string, inp
 		if err != nil {
 			panic(err)
 		}
+		buffer = buffer[:0]
+	}
+}
+
+// MaskingWriter replaces secret values with "***" before passing writes on to
+// another writer.
+type MaskingWriter struct {
+	writer   io.Writer
+	replacer *strings.Replacer
+}
+
+func NewMaskingWriter(writer io.Writer, secrets map[string]string) *MaskingWriter {
+	values := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		// log output is indented line by line, so each line of a multi-line
+		// secret has to be masked on its own too
+		for _, line := range strings.Split(secret, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				values = append(values, line)
+			}
+		}
+		if strings.TrimSpace(secret) != "" {
+			values = append(values, secret)
+		}
+	}
+	// mask the longest values first, so that a secret containing another is
+	// masked whole
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+
+	pairs := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		pairs = append(pairs, value, "***")
+	}
+	return &MaskingWriter{
+		writer:   writer,
+		replacer: strings.NewReplacer(pairs...),
+	}
+}
+
+func (writer *MaskingWriter) Write(data []byte) (int, error) {
+	_, err := io.WriteString(writer.writer, writer.replacer.Replace(string(data)))
+	return len(data), err
+}
+
+// LineWriter logs what is written to it one line at a time, indented like
+// the output of a finished command, so that the output of commands running
+// at the same time can be told apart by the logger's prefix.
+type LineWriter struct {
+	logger  *log.Logger
+	partial []byte
+}
+
+func NewLineWriter(logger *log.Logger) *LineWriter {
+	return &LineWriter{logger: logger}
+}
+
+func (writer *LineWriter) Write(data []byte) (int, error) {
+	writer.partial = append(writer.partial, data...)
+	for {
+		end := bytes.IndexByte(writer.partial, '\n')
+		if end < 0 {
+			break
+		}
+		writer.logLine(writer.partial[:end])
+		writer.partial = writer.partial[end+1:]
+	}
+	return len(data), nil
+}
+
+// Flush logs any unfinished last line.
+func (writer *LineWriter) Flush() {
+	if len(writer.partial) > 0 {
+		writer.logLine(writer.partial)
+		writer.partial = nil
+	}
+}
+
+func (writer *LineWriter) logLine(line []byte) {
+	if trimmed := strings.TrimRight(string(line), " \t\r"); trimmed != "" {
+		writer.logger.Println("    " + trimmed)
 	}
 }
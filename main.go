@@ -12,19 +12,50 @@ var ENV_PREFIX = "INTEGRAD_"
 var SOCKET_PATH string
 var DB_PATH string
 var SHELL string
+var SECRET_KEY_PATH string
+var PASSTHROUGH string
+var BUILD_USER string
+var BUILD_USERS string
+var LIMIT_CPU string
+var LIMIT_MEMORY string
+var LIMIT_PROCESSES string
+var LIMIT_OUTPUT string
+var DATA_PATH string
+var CACHE_SIZE string
+var RETENTION string
+var COALESCE string
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == WRAPPER_COMMAND {
+		os.Exit(ExecWrapper(os.Args[2:]))
+	}
 
 	SOCKET_PATH = getEnvConfig("SOCKET", "/var/integrad/integrad.sock")
 	DB_PATH = getEnvConfig("DB", "/var/integrad/integrad.db")
 	SHELL = getEnvConfig("SHELL", "bash")
+	SECRET_KEY_PATH = getEnvConfig("SECRET_KEY", "/var/integrad/secret.key")
+	PASSTHROUGH = getEnvConfig("PASSTHROUGH", "")
+	BUILD_USER = getEnvConfig("BUILD_USER", "")
+	BUILD_USERS = getEnvConfig("BUILD_USERS", "")
+	LIMIT_CPU = getEnvConfig("LIMIT_CPU", "")
+	LIMIT_MEMORY = getEnvConfig("LIMIT_MEMORY", "")
+	LIMIT_PROCESSES = getEnvConfig("LIMIT_PROCESSES", "")
+	LIMIT_OUTPUT = getEnvConfig("LIMIT_OUTPUT", "")
+	DATA_PATH = getEnvConfig("DATA", "/var/integrad/data")
+	CACHE_SIZE = getEnvConfig("CACHE_SIZE", "1G")
+	RETENTION = getEnvConfig("RETENTION", "")
+	COALESCE = getEnvConfig("COALESCE", "false")
 
 	status := cli.NewCommand("status", "view status of jobs").
 		WithOption(cli.NewOption("job", "job ID").WithChar('j').WithType(cli.TypeInt)).
+		WithOption(cli.NewOption("output", "json, yaml or table").WithChar('o')).
+		WithOption(cli.NewOption("format", "Go template applied to each result").WithChar('f')).
 		WithAction(StatusCommand)
 
 	logs := cli.NewCommand("logs", "view the logs for a job").
 		WithArg(cli.NewArg("job", "job ID")).
+		WithOption(cli.NewOption("output", "json, yaml or table").WithChar('o')).
+		WithOption(cli.NewOption("format", "Go template applied to each result").WithChar('f')).
 		WithAction(LogsCommand)
 
 	shutdown := cli.NewCommand("shutdown", "shutdown the server").
@@ -32,13 +63,112 @@ func main() {
 
 	deploy := cli.NewCommand("deploy", "deploy a project").
 		WithOption(cli.NewOption("git", "git branch or commit hash").WithChar('g')).
+		WithOption(cli.NewOption("ref", "branch the commit was pushed to, for coalescing jobs").WithChar('r')).
+		WithOption(cli.NewOption("priority", "low, normal or high").WithChar('p')).
+		WithOption(cli.NewOption("after", "jobs that must succeed first, comma-separated").WithChar('a')).
+		WithOption(cli.NewOption("env", "environment from deploy.yaml to deploy to").WithChar('e')).
+		WithOption(cli.NewOption("wait", "wait for the job to finish").WithChar('w').WithType(cli.TypeBool)).
+		WithOption(cli.NewOption("logs", "show the job's logs while waiting").WithChar('l').WithType(cli.TypeBool)).
+		WithOption(cli.NewOption("output", "json, yaml or table").WithChar('o')).
+		WithOption(cli.NewOption("format", "Go template applied to each result").WithChar('f')).
 		WithArg(cli.NewArg("source", "location of the project source")).
 		WithAction(DeployCommand)
 
 	restart := cli.NewCommand("restart", "restart a job").
 		WithArg(cli.NewArg("job", "job ID").WithType(cli.TypeInt)).
+		WithOption(cli.NewOption("output", "json, yaml or table").WithChar('o')).
+		WithOption(cli.NewOption("format", "Go template applied to each result").WithChar('f')).
 		WithAction(RestartCommand)
 
+	wait := cli.NewCommand("wait", "wait for a job to finish, exiting with 0 if it succeeded").
+		WithArg(cli.NewArg("job", "job ID").WithType(cli.TypeInt)).
+		WithOption(cli.NewOption("logs", "show the job's logs while waiting").WithChar('l').WithType(cli.TypeBool)).
+		WithOption(cli.NewOption("output", "json, yaml or table").WithChar('o')).
+		WithOption(cli.NewOption("format", "Go template applied to each result").WithChar('f')).
+		WithAction(WaitCommand)
+
+	approve := cli.NewCommand("approve", "deploy a job that is waiting for approval").
+		WithArg(cli.NewArg("job", "job ID").WithType(cli.TypeInt)).
+		WithAction(ApproveCommand)
+
+	reject := cli.NewCommand("reject", "cancel a job that is waiting for approval").
+		WithArg(cli.NewArg("job", "job ID").WithType(cli.TypeInt)).
+		WithAction(RejectCommand)
+
+	deployments := cli.NewCommand("deployments", "list the last successful deploy of each project and environment").
+		WithAction(DeploymentsCommand)
+
+	run := cli.NewCommand("run", "run a project's deploy.yaml locally, without the server").
+		WithArg(cli.NewArg("dir", "project directory").AsOptional()).
+		WithOption(cli.NewOption("env", "environment from deploy.yaml to deploy to").WithChar('e')).
+		WithOption(cli.NewOption("no-deploy", "only run the build section").WithType(cli.TypeBool)).
+		WithOption(cli.NewOption("dry-run", "show what would run without running it").WithType(cli.TypeBool)).
+		WithAction(RunLocalCommand)
+
+	validate := cli.NewCommand("validate", "check a project's deploy.yaml").
+		WithArg(cli.NewArg("dir", "project directory").AsOptional()).
+		WithAction(ValidateCommand)
+
+	secretSet := cli.NewCommand("set", "set a secret, reading the value from stdin if not given").
+		WithArg(cli.NewArg("name", "secret name")).
+		WithArg(cli.NewArg("value", "secret value").AsOptional()).
+		WithAction(SecretSetCommand)
+
+	secretList := cli.NewCommand("list", "list the names of all secrets").
+		WithAction(SecretListCommand)
+
+	secretRemove := cli.NewCommand("rm", "remove a secret").
+		WithArg(cli.NewArg("name", "secret name")).
+		WithAction(SecretRemoveCommand)
+
+	secret := cli.NewCommand("secret", "manage secrets available to deployments").
+		WithCommand(secretSet).
+		WithCommand(secretList).
+		WithCommand(secretRemove)
+
+	artifactsGet := cli.NewCommand("get", "extract a job's artifact").
+		WithArg(cli.NewArg("job", "job ID").WithType(cli.TypeInt)).
+		WithArg(cli.NewArg("path", "artifact file or directory")).
+		WithOption(cli.NewOption("dest", "directory to extract to").WithChar('d')).
+		WithAction(ArtifactsGetCommand)
+
+	artifacts := cli.NewCommand("artifacts", "list the artifacts of a job").
+		WithArg(cli.NewArg("job", "job ID").WithType(cli.TypeInt)).
+		WithCommand(artifactsGet).
+		WithAction(ArtifactsCommand)
+
+	queueMove := cli.NewCommand("move", "move a queued job to a position in the queue").
+		WithArg(cli.NewArg("job", "job ID").WithType(cli.TypeInt)).
+		WithArg(cli.NewArg("position", "new position, starting from 1").WithType(cli.TypeInt)).
+		WithAction(QueueMoveCommand)
+
+	queueRemove := cli.NewCommand("rm", "cancel a queued job").
+		WithArg(cli.NewArg("job", "job ID").WithType(cli.TypeInt)).
+		WithAction(QueueRemoveCommand)
+
+	queue := cli.NewCommand("queue", "list queued jobs in the order they will run").
+		WithCommand(queueMove).
+		WithCommand(queueRemove).
+		WithAction(QueueCommand)
+
+	scheduleAdd := cli.NewCommand("add", "run a project on a cron schedule").
+		WithOption(cli.NewOption("git", "git branch or commit hash").WithChar('g')).
+		WithArg(cli.NewArg("source", "location of the project source")).
+		WithArg(cli.NewArg("cron", "cron expression, such as '0 3 * * *'")).
+		WithAction(ScheduleAddCommand)
+
+	scheduleList := cli.NewCommand("list", "list all schedules").
+		WithAction(ScheduleListCommand)
+
+	scheduleRemove := cli.NewCommand("rm", "remove a schedule").
+		WithArg(cli.NewArg("id", "schedule ID").WithType(cli.TypeInt)).
+		WithAction(ScheduleRemoveCommand)
+
+	schedule := cli.NewCommand("schedule", "manage scheduled jobs").
+		WithCommand(scheduleAdd).
+		WithCommand(scheduleList).
+		WithCommand(scheduleRemove)
+
 	server := cli.NewCommand("server", "run the integrad server").
 		WithAction(RunServer)
 
@@ -48,7 +178,17 @@ func main() {
 		WithCommand(deploy).
 		WithCommand(status).
 		WithCommand(restart).
-		WithCommand(logs)
+		WithCommand(wait).
+		WithCommand(approve).
+		WithCommand(reject).
+		WithCommand(logs).
+		WithCommand(deployments).
+		WithCommand(validate).
+		WithCommand(run).
+		WithCommand(secret).
+		WithCommand(artifacts).
+		WithCommand(queue).
+		WithCommand(schedule)
 
 	os.Exit(app.Run(os.Args, os.Stdout))
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// MatrixAxis is a single variable of a matrix and the values it takes.
+type MatrixAxis struct {
+	Name   string
+	Values []string
+}
+
+// Matrix is the `matrix` section, written as a mapping of environment
+// variables to lists of values.  The build steps run once for every
+// combination of values.
+type Matrix []MatrixAxis
+
+func (matrix *Matrix) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var pairs yaml.MapSlice
+	if err := unmarshal(&pairs); err != nil {
+		return err
+	}
+
+	axes := make(Matrix, 0, len(pairs))
+	for _, pair := range pairs {
+		name, ok := pair.Key.(string)
+		if !ok {
+			return fmt.Errorf("matrix variable name must be a string, got %v", pair.Key)
+		}
+		list, ok := pair.Value.([]interface{})
+		if !ok {
+			return fmt.Errorf("matrix variable '%s' must be a list of values", name)
+		}
+		axis := MatrixAxis{Name: name}
+		for _, value := range list {
+			axis.Values = append(axis.Values, fmt.Sprint(value))
+		}
+		axes = append(axes, axis)
+	}
+	*matrix = axes
+	return nil
+}
+
+// Cells returns every combination of the matrix's values, in the order they
+// were written, with the last variable changing fastest.
+func (matrix Matrix) Cells() []EnvList {
+	if len(matrix) == 0 {
+		return nil
+	}
+	cells := []EnvList{nil}
+	for _, axis := range matrix {
+		expanded := make([]EnvList, 0, len(cells)*len(axis.Values))
+		for _, cell := range cells {
+			for _, value := range axis.Values {
+				vars := append(EnvList{}, cell...)
+				expanded = append(expanded, append(vars, EnvVar{Name: axis.Name, Value: value}))
+			}
+		}
+		cells = expanded
+	}
+	return cells
+}
+
+// cellLabel names a matrix cell in logs and job results.
+func cellLabel(cell EnvList) string {
+	vars := make([]string, len(cell))
+	for i, v := range cell {
+		vars[i] = v.Name + "=" + v.Value
+	}
+	return strings.Join(vars, " ")
+}
+
+// runMatrix runs the build steps once for every cell of the matrix, with the
+// cell's variables added to the environment.  Every cell runs even if an
+// earlier one failed; the first failure is returned, with the label of the
+// failed step naming its cell.
+func (d *deployment) runMatrix(steps []Step) (string, error) {
+	cells := d.config.Matrix.Cells()
+	var failedStep string
+	var failure error
+	failed := 0
+	for i, cell := range cells {
+		d.cell = cellLabel(cell)
+		d.logger.Printf("Running build for matrix cell %d/%d: %s", i+1, len(cells), d.cell)
+		step, err := d.runStepList(d.build.Source, "build", steps, cell.Apply(d.env))
+		if err != nil {
+			failed++
+			if failure == nil {
+				failedStep = fmt.Sprintf("%s (%s)", step, d.cell)
+				failure = err
+			}
+		}
+	}
+	d.cell = ""
+
+	if failed > 0 {
+		d.logger.Printf("Build failed for %d of %d matrix cells", failed, len(cells))
+	}
+	return failedStep, failure
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestMatrixCells(t *testing.T) {
+	tests := []struct {
+		matrix string
+		cells  []string
+	}{
+		{"{}", nil},
+		{"{GO: [1.21]}", []string{"GO=1.21"}},
+		{"{GO: [1.21, 1.22], DB: [pg, mysql]}", []string{
+			"GO=1.21 DB=pg", "GO=1.21 DB=mysql", "GO=1.22 DB=pg", "GO=1.22 DB=mysql",
+		}},
+		{"{Z: [b, a], A: [x], M: [1, 2]}", []string{
+			"Z=b A=x M=1", "Z=b A=x M=2", "Z=a A=x M=1", "Z=a A=x M=2",
+		}},
+		{"{GO: [1.22], DB: []}", []string{}},
+	}
+	for _, test := range tests {
+		var matrix Matrix
+		if err := yaml.Unmarshal([]byte(test.matrix), &matrix); err != nil {
+			t.Errorf("%s: %v", test.matrix, err)
+			continue
+		}
+		var cells []string
+		for _, cell := range matrix.Cells() {
+			cells = append(cells, cellLabel(cell))
+		}
+		if len(cells) == 0 && len(test.cells) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(cells, test.cells) {
+			t.Errorf("%s: cells are %q, expected %q", test.matrix, cells, test.cells)
+		}
+	}
+}
+
+func TestMatrixInvalid(t *testing.T) {
+	for _, matrix := range []string{"[a, b]", "{GO: 1.22}", "{1: [a]}"} {
+		var parsed Matrix
+		if err := yaml.Unmarshal([]byte(matrix), &parsed); err == nil {
+			t.Errorf("%s: expected an error", matrix)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Exit codes of the client commands.
+const (
+	ExitSuccess = 0
+	// ExitError is used when a command fails, or the server can't be
+	// reached.
+	ExitError = 1
+	// ExitNotFound is used when the job, or anything else a command asked
+	// for, doesn't exist.
+	ExitNotFound = 2
+	// ExitJobFailed is used when a job that was waited for didn't succeed.
+	ExitJobFailed = 3
+	// ExitAwaitingApproval is used when a job that was waited for stopped at
+	// its approval gate.
+	ExitAwaitingApproval = 4
+)
+
+// jobExitCode returns the exit code for a job that has finished.
+func jobExitCode(status JobStatus) int {
+	switch status {
+	case Succeeded:
+		return ExitSuccess
+	case AwaitingApproval:
+		return ExitAwaitingApproval
+	default:
+		return ExitJobFailed
+	}
+}
+
+// commandError prints an error of a client command, and returns the exit
+// code for it.
+func commandError(err error) int {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	var notFoundErr *NotFoundError
+	if errors.As(err, &notFoundErr) {
+		return ExitNotFound
+	}
+	return ExitError
+}
+
+// Output is how a client command prints its result: as a table for people,
+// as JSON or YAML, or through a Go template.
+type Output struct {
+	Kind     string
+	Template *template.Template
+}
+
+// ParseOutput reads the --output and --format options of a command.  Both are
+// checked before anything is sent to the server, so that a typo doesn't
+// leave a job queued without its number being printed.
+func ParseOutput(options map[string]string) (output Output, err error) {
+	output.Kind = options["output"]
+	switch output.Kind {
+	case "":
+		output.Kind = "table"
+	case "table", "json", "yaml":
+	default:
+		return output, fmt.Errorf("unknown output format '%s', expected json, yaml or table", output.Kind)
+	}
+
+	if format, ok := options["format"]; ok {
+		output.Template, err = template.New("format").Parse(format)
+	}
+	return
+}
+
+// Print writes value in the chosen format, calling table to print it for
+// people.  A template is applied to each element of value if it is a slice.
+func (output Output) Print(value interface{}, table func()) error {
+	if output.Template != nil {
+		items := reflect.ValueOf(value)
+		if items.Kind() != reflect.Slice {
+			return output.execute(value)
+		}
+		for i := 0; i < items.Len(); i++ {
+			if err := output.execute(items.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch output.Kind {
+	case "json":
+		buf, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+	case "yaml":
+		// going through JSON keeps the field names, and what is left out,
+		// the same in both formats
+		buf, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		var fields interface{}
+		if err = yaml.Unmarshal(buf, &fields); err != nil {
+			return err
+		}
+		buf, err = yaml.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(buf))
+	default:
+		table()
+	}
+	return nil
+}
+
+// progress returns where to write messages that aren't part of the result,
+// such as the logs of a job being waited for.  They go to standard error when
+// the result is meant for another program.
+func (output Output) progress() io.Writer {
+	if output.Kind == "table" && output.Template == nil {
+		return os.Stdout
+	}
+	return os.Stderr
+}
+
+func (output Output) execute(value interface{}) error {
+	if err := output.Template.Execute(os.Stdout, value); err != nil {
+		return err
+	}
+	fmt.Println()
+	return nil
+}
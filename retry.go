@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// Retry is how many times to retry something that failed, and how long to
+// wait before the first retry.  The wait doubles with every retry after that.
+type Retry struct {
+	Retries int
+	Backoff Duration
+}
+
+const defaultBackoff = 5 * time.Second
+
+// Do calls attempt until it succeeds or the retries run out, logging each
+// failure.  It returns the number of attempts made.  Commands stopped by a
+// resource limit aren't retried, since they would only hit it again, and
+// neither are cancelled ones.  Cancelling ctx while waiting to retry ends the
+// wait with errStepCancelled.
+func (retry Retry) Do(ctx context.Context, logger *log.Logger, attempt func() error) (int, error) {
+	backoff := time.Duration(retry.Backoff)
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+
+	attempts := 0
+	for {
+		attempts++
+		err := attempt()
+		var limitErr *LimitError
+		if err == nil || attempts > retry.Retries || errors.As(err, &limitErr) || err == errStepCancelled {
+			return attempts, err
+		}
+		if ctx.Err() != nil {
+			return attempts, errStepCancelled
+		}
+
+		logger.Printf("Attempt %d/%d failed: %v", attempts, retry.Retries+1, err)
+		logger.Printf("Retrying in %v", backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return attempts, errStepCancelled
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryDo(t *testing.T) {
+	failure := errors.New("failed")
+	tests := []struct {
+		name     string
+		retries  int
+		errs     []error
+		attempts int
+		err      error
+	}{
+		{name: "success", retries: 2, errs: []error{nil}, attempts: 1},
+		{name: "success on retry", retries: 2, errs: []error{failure, failure, nil}, attempts: 3},
+		{name: "retries run out", retries: 1, errs: []error{failure, failure, nil}, attempts: 2, err: failure},
+		{name: "no retries", errs: []error{failure, nil}, attempts: 1, err: failure},
+		{name: "cancelled", retries: 2, errs: []error{errStepCancelled, nil}, attempts: 1, err: errStepCancelled},
+		{name: "limit exceeded", retries: 2, errs: []error{&LimitError{}, nil}, attempts: 1},
+	}
+	for _, test := range tests {
+		retry := Retry{Retries: test.retries, Backoff: Duration(time.Millisecond)}
+		calls := 0
+		attempts, err := retry.Do(context.Background(), log.New(&bytes.Buffer{}, "", 0), func() error {
+			calls++
+			return test.errs[calls-1]
+		})
+		if attempts != test.attempts || calls != test.attempts {
+			t.Errorf("%s: %d attempts and %d calls, expected %d", test.name, attempts, calls, test.attempts)
+		}
+		if test.err != nil && err != test.err {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestRetryDoCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var output bytes.Buffer
+	retry := Retry{Retries: 3, Backoff: Duration(time.Minute)}
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+	started := time.Now()
+	attempts, err := retry.Do(ctx, log.New(&output, "", 0), func() error {
+		return errors.New("failed")
+	})
+	if err != errStepCancelled || attempts != 1 {
+		t.Errorf("got %v after %d attempts, expected cancellation after 1", err, attempts)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("waited %v after being cancelled", elapsed)
+	}
+
+	// once cancelled, a failure isn't retried at all
+	output.Reset()
+	attempts, err = retry.Do(ctx, log.New(&output, "", 0), func() error {
+		return errors.New("failed")
+	})
+	if err != errStepCancelled || attempts != 1 || strings.Contains(output.String(), "Retrying") {
+		t.Errorf("got %v after %d attempts, logging %q", err, attempts, output.String())
+	}
+}
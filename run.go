@@ -1,105 +1,223 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
-	"sync"
+	"time"
 
 	"github.com/kr/text"
 )
 
-func mapEnv(env []string) func(string) string {
-	envMap := make(map[string]string)
-	for _, v := range env {
-		split := strings.Split(v, "=")
-		envMap[split[0]] = split[1]
-	}
-	return func(key string) string {
-		return envMap[key]
-	}
+// jobWorkspace is the directory that a job's source and build directories are
+// checked out in.
+func jobWorkspace(number int) string {
+	return filepath.Join("/tmp/integrad", fmt.Sprintf("job-%d", number))
+}
+
+// RemoveWorkspace removes the checked out directories of a job.
+func RemoveWorkspace(number int) {
+	os.RemoveAll(jobWorkspace(number))
 }
 
-func RunJob(job Job, logger *log.Logger) error {
+// RunJob fetches and runs a job.  An approved job carries on in the
+// workspace it was built in, which is otherwise removed when the job ends,
+// unless it stops to wait for approval.
+func RunJob(job *Job, secrets map[string]string, logger *log.Logger) (err error) {
+	defer func() {
+		if !errors.Is(err, errAwaitingApproval) {
+			RemoveWorkspace(job.Number)
+		}
+	}()
+
+	if job.Approval != nil && job.Approval.Approved {
+		logger.Println("Approved, continuing with the deploy.")
+		return RunDeploy(job.Approval.Workspace, job, secrets, logger)
+	}
 
 	source := job.Args["source"]
 	var build BuildConfig
 
-	var err error
 	if version, ok := job.Args["git"]; ok {
-		build, err = GitSourceVersion(source, "/tmp/integrad", version, logger)
+		started := time.Now()
+		attempts, err := fetchRetry(source, version).Do(context.Background(), logger, func() (err error) {
+			build, err = GitSourceVersion(source, jobWorkspace(job.Number), version, logger)
+			if err != nil {
+				// start the next attempt from scratch
+				os.RemoveAll(build.Source)
+				os.RemoveAll(build.Build)
+			}
+			return err
+		})
+		job.RecordAttempts("fetch", "fetch", started, attempts, err)
 		if err != nil {
 			return err
 		}
 	} else {
 		return fmt.Errorf("VCS version must be provided")
 	}
-	defer os.RemoveAll(build.Source)
-	defer os.RemoveAll(build.Build)
 
-	err = RunDeploy(build, logger)
+	return RunDeploy(build, job, secrets, logger)
+}
+
+// fetchRetry reads the fetch section of the deploy.yaml being fetched,
+// before the full clone.  If it can't be read, the fetch isn't retried; the
+// problem is reported once the configuration is loaded properly.
+func fetchRetry(source, version string) Retry {
+	contents, err := GitShowFile(source, version, "deploy.yaml")
 	if err != nil {
-		return err
+		return Retry{}
+	}
+	config, err := ParseConfig(contents, ValidationBuild)
+	if err != nil {
+		return Retry{}
 	}
+	return config.Fetch
+}
+
+// deployment holds the state of a single run of a project's deploy.yaml.
+type deployment struct {
+	build   BuildConfig
+	config  Config
+	env     []string
+	runner  Runner
+	sandbox *SandboxOptions
+	limits  *JobLimits
+	backup  *Backup
+	cache   *BuildCache
+	// resumed is set when an approved job carries on after its build.
+	resumed bool
+	// local is set for runs of `integrad run`.
+	local *LocalOptions
+	// cell is the label of the matrix cell whose build steps are running.
+	cell   string
+	job    *Job
+	logger *log.Logger
+}
 
-	return nil
+// RunDeploy runs the deploy.yaml of a checked out project.  Secrets
+// referenced by the configuration are looked up by name in secrets.
+func RunDeploy(build BuildConfig, job *Job, secrets map[string]string, logger *log.Logger) error {
+	return runDeploy(build, job, secrets, nil, logger)
 }
 
-func RunDeploy(build BuildConfig, logger *log.Logger) error {
+// runDeploy runs a deploy on the server, or locally for `integrad run` if
+// local is set.
+func runDeploy(build BuildConfig, job *Job, secrets map[string]string, local *LocalOptions, logger *log.Logger) error {
 
 	config, err := LoadConfig(build)
+	if err == nil {
+		config, err = config.ForEnvironment(job.Environment)
+	}
 	if err != nil {
 		logger.Printf("Error loading configuration:\n %v",
 			text.Indent(err.Error(), "    "))
 		return err
 	}
-	env := os.Environ()
-	for k, v := range config.Env {
-		env = append(env, k+"="+v)
+	if job.Environment != "" {
+		logger.Printf("Deploying to the %s environment", job.Environment)
 	}
-
-	for i, cmd := range config.Build {
-		logger.Printf("Running build command %d/%d: %s", i+1, len(config.Build), cmd)
-		output, err := RunCommandEnv(build.Source, env, SHELL, "-c", cmd)
-		if trimmed := strings.TrimSpace(output); len(trimmed) > 0 {
-			logger.Println(text.Indent(trimmed, "    "))
+	job.Triggers = config.Triggers
+	env := BaseEnv()
+	for k, name := range config.Secrets {
+		value, ok := secrets[name]
+		if !ok {
+			err = fmt.Errorf("secret '%s' is not set", name)
+			logger.Printf("Error loading configuration: %v", err)
+			return err
 		}
+		env = setEnv(env, k, value)
+	}
+	env = setEnv(env, ENV_PREFIX+"ENVIRONMENT", job.Environment)
+	env = config.Env.Apply(env)
+
+	limits, err := ServerLimits()
+	if err != nil {
+		logger.Printf("Error loading resource limits: %v", err)
+		return err
+	}
+
+	// local runs stay with the user that started them
+	var runner Runner
+	if local == nil {
+		runner, err = NewRunner(config.User)
 		if err != nil {
-			logger.Printf("Error while running command: %v", err)
+			logger.Printf("Error setting up build user: %v", err)
 			return err
 		}
 	}
 
-	lookup := mapEnv(env)
-	for source, dest := range config.Deploy {
-		if !filepath.IsAbs(source) {
-			source = filepath.Join(build.Build, source)
+	d := deployment{
+		build:   build,
+		config:  config,
+		env:     env,
+		runner:  runner,
+		limits:  NewJobLimits(limits.Merge(config.Limits)),
+		resumed: job.Approval != nil && job.Approval.Approved,
+		local:   local,
+		job:     job,
+		logger:  logger,
+	}
+	defer d.limits.Close()
+	if config.Cache != nil && local == nil {
+		d.cache = NewBuildCache(job.Args["source"], *config.Cache, build)
+		if !d.resumed {
+			d.restoreCache()
 		}
-		source = os.Expand(source, lookup)
-		dest = os.Expand(dest, lookup)
-		logger.Printf("Deploying '%s' to %s'", source, dest)
-		err = MoveAll(source, dest)
+	}
+
+	if !d.resumed {
+		err = runner.Own(build.Source, build.Build)
 		if err != nil {
-			logger.Printf("Error while moving file: %v", err)
+			logger.Printf("Error setting up build user: %v", err)
 			return err
 		}
 	}
+	if config.Sandbox.Enabled {
+		d.sandbox = &SandboxOptions{
+			Network:  config.Sandbox.Network,
+			Writable: []string{build.Source, build.Build},
+		}
+	}
+	if config.Health != nil && config.Health.Rollback {
+		d.backup = NewBackup(build.Build + "-previous")
+		defer d.backup.Remove()
+	}
 
-	for i, cmd := range config.Post {
-		logger.Printf("Running post-build command %d/%d: %s", i+1, len(config.Build), cmd)
-		output, err := RunCommandEnv(build.Build, env, SHELL, "-c", cmd)
-		logger.Println(text.Indent(output, "    "))
+	failedStep, err := d.runSteps()
+	if err == errAwaitingApproval {
+		// the build is what the approver has to judge, so its artifacts are
+		// archived now, and again once the job is finished
+		if len(config.Artifacts) > 0 {
+			d.archiveArtifacts()
+		}
+		return err
+	}
+	if err == nil && config.Health != nil && d.deploys() {
+		started := time.Now()
+		err = config.Health.Run(build.Build, env, runner, logger)
+		job.RecordStep("healthcheck", "healthcheck", started, err)
 		if err != nil {
-			logger.Printf("Error while running command: %v", err)
-			return err
+			failedStep = "healthcheck"
+			if d.backup != nil {
+				d.rollback()
+			}
 		}
 	}
+	if len(config.Artifacts) > 0 && local == nil {
+		d.archiveArtifacts()
+	}
+	if err == nil && d.cache != nil {
+		d.saveCache()
+	}
+	// hooks usually notify people or restart services, which a local build
+	// shouldn't do
+	if d.deploys() {
+		d.runHooks(failedStep, err)
+	}
 
 	if err == nil {
 		logger.Println("Deploy succeeded.")
@@ -109,70 +227,131 @@ func RunDeploy(build BuildConfig, logger *log.Logger) error {
 	return err
 }
 
-func RunCommand(cwd, name string, args ...string) (string, error) {
-	return RunCommandEnv(cwd, os.Environ(), name, args...)
-}
-
-func RunCommandEnv(cwd string, env []string, name string, args ...string) (string, error) {
-	var buffer bytes.Buffer
-	writer := bufio.NewWriter(&buffer)
+// runSteps runs the build, deploy and post sections of the configuration,
+// stopping at the first error.  The name of the step that failed is returned
+// along with the error.  With a matrix, the build section runs once per cell.
+// With an approval gate, the job stops after the build until it is approved,
+// and then carries on from the deploy section.  If there is a backup, each
+// deploy destination is saved to it before being overwritten.
+func (d *deployment) runSteps() (string, error) {
+	var failedStep string
+	var err error
+	if !d.resumed {
+		if len(d.config.Matrix) > 0 {
+			failedStep, err = d.runMatrix(d.config.Build)
+		} else {
+			failedStep, err = d.runStepList(d.build.Source, "build", d.config.Build, d.env)
+		}
+		if err != nil {
+			return failedStep, err
+		}
+		if !d.deploys() {
+			d.logger.Println("Skipping the deploy, post and hook sections")
+			return "", nil
+		}
+		if d.config.Approval.Enabled {
+			if d.local == nil {
+				return "", d.awaitApproval()
+			}
+			d.logger.Println("Not waiting for approval in a local run")
+		}
+	}
 
-	cmd := exec.Command(name, args...)
-	cmd.Dir = cwd
-	cmd.Env = env
-	cmd.Stdout = writer
-	cmd.Stderr = writer
+	lookup := mapEnv(d.env)
+	for _, entry := range d.config.Deploy {
+		source := entry.Source
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(d.build.Build, source)
+		}
+		source = os.Expand(source, lookup)
+		dest := os.Expand(entry.Dest, lookup)
 
-	err := cmd.Run()
-	if err != nil {
-		if ee, ok := err.(*exec.ExitError); ok {
-			ee.Stderr = buffer.Bytes()
+		started := time.Now()
+		source, err = resolveSource(d.build.Build, source)
+		if err != nil {
+			d.logger.Printf("Error while deploying '%s': %v", entry.Source, err)
+			d.job.RecordStep("deploy", entry.Source, started, err)
+			return entry.Source, err
+		}
+		if d.backup != nil {
+			err = d.backup.Save(dest)
+			if err != nil {
+				d.logger.Printf("Error while backing up '%s': %v", dest, err)
+				d.job.RecordStep("deploy", entry.Source, started, err)
+				return entry.Source, err
+			}
+		}
+		d.logger.Printf("Deploying '%s' to '%s'", source, dest)
+		err = CopyEntry(entry, source, dest)
+		d.job.RecordStep("deploy", entry.Source, started, err)
+		if err != nil {
+			d.logger.Printf("Error while copying files: %v", err)
+			return entry.Source, err
 		}
 	}
-	return buffer.String(), err
+
+	return d.runStepList(d.build.Build, "post", d.config.Post, d.env)
 }
 
-func MoveAll(source, dest string) error {
-	var wg sync.WaitGroup
-	walk := func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		destPath := filepath.Join(dest, path[len(source):])
-		perms := info.Mode().Perm()
+// deploys reports whether the deploy, post and hook sections run.
+func (d *deployment) deploys() bool {
+	return d.local == nil || !d.local.NoDeploy
+}
 
-		if info.IsDir() {
-			os.MkdirAll(destPath, perms)
-		} else {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
+// rollback restores the deploy destinations saved in the backup and runs the
+// post steps again, so that services are restarted on the previous release.
+func (d *deployment) rollback() {
+	d.logger.Println("Rolling back to the previous release")
+	err := d.backup.Restore()
+	if err != nil {
+		d.logger.Printf("Error while restoring the previous release: %v", err)
+		return
+	}
 
-				os.MkdirAll(filepath.Dir(destPath), 0755)
+	_, err = d.runStepList(d.build.Build, "rollback", d.config.Post, d.env)
+	if err == nil {
+		d.logger.Println("Rollback succeeded.")
+	}
+}
 
-				read, err := os.Open(path)
-				if err != nil {
-					return
-				}
-				defer read.Close()
+// runHooks runs the on_success or on_failure steps, followed by the always
+// steps.  Hooks are told the outcome through INTEGRAD_STATUS,
+// INTEGRAD_FAILED_STEP and INTEGRAD_FAILURE_REASON.  A failing hook is logged
+// but doesn't change the outcome of the deploy.
+func (d *deployment) runHooks(failedStep string, failure error) {
+	status := "success"
+	reason := ""
+	hooks := d.config.OnSuccess
+	section := "on_success"
+	if failure != nil {
+		status = "failure"
+		reason = failure.Error()
+		hooks = d.config.OnFailure
+		section = "on_failure"
+	}
 
-				write, err := os.Create(destPath)
-				if err != nil {
-					log.Panic(err)
-				}
-				defer write.Chmod(perms)
-				defer write.Close()
+	env := appendEnv(d.env,
+		ENV_PREFIX+"STATUS="+status,
+		ENV_PREFIX+"FAILED_STEP="+failedStep,
+		ENV_PREFIX+"FAILURE_REASON="+reason)
+
+	d.runHookSteps(section, hooks, env)
+	d.runHookSteps("always", d.config.Always, env)
+}
 
-				_, err = io.Copy(write, read)
-			}()
+func (d *deployment) runHookSteps(section string, steps []Step, env []string) {
+	for i := range steps {
+		err := d.runStep(d.build.Build, section, i, steps, env)
+		if err != nil {
+			d.logger.Printf("Error while running %s step: %v", section, err)
 		}
-		return nil
-	}
-	err := filepath.Walk(source, walk)
-	wg.Wait()
-	if err != nil {
-		return err
 	}
+}
 
-	return nil
+func RunCommand(cwd, name string, args ...string) (string, error) {
+	return RunCommandEnv(cwd, os.Environ(), name, args...)
+}
+
+func RunCommandEnv(cwd string, env []string, name string, args ...string) (string, error) {
+	return Runner{}.Run(context.Background(), cwd, env, name, args...)
 }
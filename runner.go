@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Runner decides how the commands of a job are run.
+type Runner struct {
+	// Credential is the unprivileged user that commands run as, or nil to
+	// run them as the server's own user.
+	Credential *syscall.Credential
+	// Home is the home directory of the unprivileged user, if it has one.
+	Home string
+	// Sandbox, if set, isolates commands from the rest of the system.
+	Sandbox *SandboxOptions
+	// Limits are the limits of the job that commands count towards, or nil
+	// if there are none.
+	Limits *JobLimits
+	// Workspace holds the directories counted towards the output limit.
+	Workspace []string
+	// Output, if set, is also given the output of commands as it is written.
+	Output io.Writer
+}
+
+// WRAPPER_COMMAND is the hidden command that sets up sandboxing and resource
+// limits from inside a new process before replacing it with the real command.
+const WRAPPER_COMMAND = "exec-wrapper"
+
+// NewRunner returns the runner for a project.  Build commands run as the
+// project's own user if it sets one, or otherwise as INTEGRAD_BUILD_USER.
+// Since the project's user comes from its deploy.yaml, it has to be
+// INTEGRAD_BUILD_USER or one of INTEGRAD_BUILD_USERS.  Switching users is
+// only possible when the server is running as root.
+func NewRunner(projectUser string) (runner Runner, err error) {
+	name := BUILD_USER
+	if projectUser != "" {
+		name = projectUser
+	}
+	if name == "" {
+		return
+	}
+	if os.Geteuid() != 0 {
+		return runner, fmt.Errorf("can't run builds as '%s' unless the server runs as root", name)
+	}
+
+	uid, gid, err := buildUser(name)
+	if err != nil {
+		return
+	}
+	if projectUser != "" {
+		allowed := false
+		for _, other := range append(strings.Split(BUILD_USERS, ","), BUILD_USER) {
+			other = strings.TrimSpace(other)
+			if other == "" {
+				continue
+			}
+			otherUid, otherGid, err := buildUser(other)
+			if err == nil && otherUid == uid && otherGid == gid {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return runner, fmt.Errorf("user '%s' is not one of INTEGRAD_BUILD_USER or INTEGRAD_BUILD_USERS", name)
+		}
+	}
+
+	// an empty list clears the server's supplementary groups, which often
+	// include root's
+	runner.Credential = &syscall.Credential{
+		Uid:    uint32(uid),
+		Gid:    uint32(gid),
+		Groups: []uint32{},
+	}
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		runner.Home = u.HomeDir
+	}
+	return
+}
+
+// buildUser resolves a `user[:group]` that builds may run as, refusing root.
+func buildUser(name string) (uid, gid int, err error) {
+	uid, gid, err = parseOwner(name)
+	if err != nil {
+		return
+	}
+	if gid < 0 {
+		gid = uid
+	}
+	if uid == 0 || gid == 0 {
+		err = fmt.Errorf("builds can't run as '%s', which is root or in the root group", name)
+	}
+	return
+}
+
+// Privileged returns a copy of the runner that runs commands as the server's
+// own user.
+func (runner Runner) Privileged() Runner {
+	runner.Credential = nil
+	runner.Home = ""
+	return runner
+}
+
+// Own hands the given directories over to the runner's user, so that build
+// commands can write to them.
+func (runner Runner) Own(dirs ...string) error {
+	if runner.Credential == nil {
+		return nil
+	}
+	uid, gid := int(runner.Credential.Uid), int(runner.Credential.Gid)
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, uid, gid)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outputWaitDelay is how long the output of a command is still read after
+// it has exited or been stopped, in case processes it left behind hold on to
+// it.
+const outputWaitDelay = 2 * time.Second
+
+// Run runs a command and returns its combined output.  If the command was
+// stopped by one of the runner's limits, the error is a *LimitError.
+// Cancelling ctx kills the command along with every process it started.
+func (runner Runner) Run(ctx context.Context, cwd string, env []string, name string, args ...string) (string, error) {
+	var buffer bytes.Buffer
+
+	cmd, finish, err := runner.command(ctx, cwd, name, args...)
+	if err != nil {
+		return "", err
+	}
+	cmd.Dir = cwd
+	cmd.Env = env
+	var output io.Writer = &buffer
+	if runner.Output != nil {
+		output = io.MultiWriter(&buffer, runner.Output)
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if runner.Credential != nil && runner.Home != "" {
+		cmd.Env = setEnv(appendEnv(env), "HOME", runner.Home)
+	}
+	// killing only the command would leave its children running, and still
+	// writing to its output
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = outputWaitDelay
+
+	err = cmd.Run()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// the command itself succeeded, but something it started in the
+		// background kept its output open
+		err = nil
+	}
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			ee.Stderr = buffer.Bytes()
+		}
+	}
+	if limitErr := finish(cmd.ProcessState, err); limitErr != nil {
+		err = limitErr
+	} else if limitErr = runner.checkOutput(); limitErr != nil {
+		err = limitErr
+	}
+	return buffer.String(), err
+}
+
+// checkOutput enforces the output limit on the runner's workspace.
+func (runner Runner) checkOutput() error {
+	if runner.Limits == nil || runner.Limits.Output <= 0 {
+		return nil
+	}
+	var total int64
+	for _, dir := range runner.Workspace {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				total += info.Size()
+			}
+			return nil
+		})
+	}
+	if Size(total) > runner.Limits.Output {
+		return &LimitError{Resource: "output", Limit: runner.Limits.Output.String()}
+	}
+	return nil
+}
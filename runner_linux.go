@@ -0,0 +1,176 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// command prepares a command to run under the runner's user, sandbox and
+// limits.  The returned function must be called with the result of running
+// the command; it cleans up and reports any limit that was exceeded.
+func (runner Runner) command(ctx context.Context, cwd, name string, args ...string) (*exec.Cmd, func(*os.ProcessState, error) error, error) {
+	attr := &syscall.SysProcAttr{
+		Credential: runner.Credential,
+		Pdeathsig:  syscall.SIGKILL,
+	}
+	var wrapperArgs []string
+	var cleanups []func()
+	cleanup := func() {
+		for _, f := range cleanups {
+			f()
+		}
+	}
+
+	var limits Limits
+	var group *cgroup
+	var events cgroupEvents
+	if runner.Limits != nil {
+		var err error
+		limits, err = runner.Limits.commandLimits()
+		if err != nil {
+			return nil, nil, err
+		}
+		group = runner.Limits.group
+	}
+	if group != nil {
+		events = group.events()
+		attr.UseCgroupFD = true
+		attr.CgroupFD = group.fd()
+	}
+	wrapperArgs = append(wrapperArgs, rlimitArgs(limits, group != nil)...)
+
+	if runner.Sandbox != nil {
+		sandboxArgs, sandboxCleanup, err := runner.Sandbox.apply(attr, runner.Credential)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		cleanups = append(cleanups, sandboxCleanup)
+		wrapperArgs = append(wrapperArgs, "--cwd", cwd)
+		wrapperArgs = append(wrapperArgs, sandboxArgs...)
+	}
+
+	var cmd *exec.Cmd
+	if len(wrapperArgs) > 0 {
+		self, err := os.Executable()
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		wrapperArgs = append([]string{WRAPPER_COMMAND}, wrapperArgs...)
+		wrapperArgs = append(wrapperArgs, "--", name)
+		cmd = exec.CommandContext(ctx, self, append(wrapperArgs, args...)...)
+	} else {
+		cmd = exec.CommandContext(ctx, name, args...)
+	}
+	cmd.SysProcAttr = attr
+
+	finish := func(state *os.ProcessState, err error) error {
+		cleanup()
+		if runner.Limits == nil {
+			return nil
+		}
+		var exceeded error
+		if group != nil {
+			exceeded = group.exceeded(limits, events)
+		}
+		if exceeded == nil {
+			exceeded = signalledLimit(err, limits)
+		}
+		return runner.Limits.finished(state, err, exceeded)
+	}
+	return cmd, finish, nil
+}
+
+// ExecWrapper runs as the first process of a sandboxed or limited command.
+// It applies the limits, builds the sandbox if there is one, and then
+// replaces itself with the real command.
+func ExecWrapper(args []string) int {
+	var root, cwd string
+	var binds []string
+	var limits []string
+	for len(args) > 0 && args[0] != "--" {
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "integrad: missing value for %s\n", args[0])
+			return 1
+		}
+		switch args[0] {
+		case "--root":
+			root = args[1]
+		case "--cwd":
+			cwd = args[1]
+		case "--bind":
+			binds = append(binds, args[1])
+		case "--rlimit":
+			limits = append(limits, args[1])
+		default:
+			fmt.Fprintf(os.Stderr, "integrad: unknown option %s\n", args[0])
+			return 1
+		}
+		args = args[2:]
+	}
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "integrad: no command given")
+		return 1
+	}
+	args = args[1:]
+
+	for _, limit := range limits {
+		err := setRlimit(limit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "integrad: setting limit %s: %v\n", limit, err)
+			return 1
+		}
+	}
+
+	if root != "" {
+		err := setupSandbox(root, cwd, binds)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+			return 1
+		}
+
+		// the home directory is usually hidden by a scratch tmpfs
+		if home := os.Getenv("HOME"); home != "" {
+			os.MkdirAll(home, 0755)
+		}
+	}
+
+	path, err := exec.LookPath(args[0])
+	if err == nil {
+		err = syscall.Exec(path, args, os.Environ())
+	}
+	fmt.Fprintf(os.Stderr, "integrad: %v\n", err)
+	return 127
+}
+
+func setRlimit(limit string) error {
+	parts := strings.SplitN(limit, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("malformed limit")
+	}
+	value, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	resource, ok := rlimitResources[parts[0]]
+	if !ok {
+		return fmt.Errorf("unknown resource")
+	}
+
+	rlimit := syscall.Rlimit{Cur: value, Max: value}
+	if resource == syscall.RLIMIT_CPU {
+		// give the command a second to handle SIGXCPU before the hard limit
+		// kills it outright
+		rlimit.Max = value + 1
+	}
+	return syscall.Setrlimit(resource, &rlimit)
+}
@@ -0,0 +1,43 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+func (runner Runner) command(ctx context.Context, cwd, name string, args ...string) (*exec.Cmd, func(*os.ProcessState, error) error, error) {
+	if runner.Sandbox != nil {
+		return nil, nil, fmt.Errorf("sandboxing is only supported on Linux")
+	}
+	limits := runner.Limits
+	if limits != nil && (limits.CPU > 0 || limits.Memory > 0 || limits.Processes > 0) {
+		return nil, nil, fmt.Errorf("resource limits are only supported on Linux")
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: runner.Credential}
+	return cmd, func(*os.ProcessState, error) error { return nil }, nil
+}
+
+// cgroups are only used on Linux, so jobs never get one here
+type cgroup struct{}
+
+func newCgroup(limits Limits) (*cgroup, error) {
+	return nil, fmt.Errorf("cgroups are only supported on Linux")
+}
+
+func (group *cgroup) cpuUsage() time.Duration { return 0 }
+func (group *cgroup) kill()                   {}
+func (group *cgroup) remove()                 {}
+
+func ExecWrapper(args []string) int {
+	fmt.Fprintln(os.Stderr, "integrad: only supported on Linux")
+	return 1
+}
@@ -0,0 +1,32 @@
+package main
+
+// Sandbox is the `sandbox` section of the configuration.  It can be written
+// as `sandbox: true`, or as a mapping to change its options.
+type Sandbox struct {
+	Enabled bool
+	Network bool
+}
+
+func (sandbox *Sandbox) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		*sandbox = Sandbox{Enabled: enabled, Network: true}
+		return nil
+	}
+
+	type plainSandbox Sandbox
+	plain := plainSandbox{Enabled: true, Network: true}
+	if err := unmarshal(&plain); err != nil {
+		return err
+	}
+	*sandbox = Sandbox(plain)
+	return nil
+}
+
+// SandboxOptions are what a Runner needs to sandbox a command: whether it may
+// use the network, and which directories it may write to.  Everything else is
+// read-only.
+type SandboxOptions struct {
+	Network  bool
+	Writable []string
+}
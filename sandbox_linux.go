@@ -0,0 +1,248 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// directories that are replaced with empty, writable tmpfs mounts inside the
+// sandbox, hiding whatever the host keeps in them
+var sandboxScratch = []string{"/tmp", "/var/tmp", "/home", "/root", "/run"}
+
+// apply sets up attr so that the command starts in new user, mount and PID
+// namespaces, plus a network namespace if networking is disabled.  It returns
+// the wrapper options that build the sandbox from inside those namespaces,
+// and a function that cleans up after the command has finished.
+func (options *SandboxOptions) apply(attr *syscall.SysProcAttr, credential *syscall.Credential) ([]string, func(), error) {
+	// an empty directory to build the sandbox's root filesystem on
+	root, err := ioutil.TempDir("", "integrad-sandbox-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.Remove(root) }
+	if err = os.Chmod(root, 0755); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	args := []string{"--root", root}
+	for _, dir := range options.Writable {
+		args = append(args, "--bind", dir)
+	}
+
+	uid, gid := os.Getuid(), os.Getgid()
+	if credential != nil {
+		uid, gid = int(credential.Uid), int(credential.Gid)
+	}
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID
+	if !options.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+
+	attr.Cloneflags = uintptr(flags)
+	// the build runs as root inside the sandbox, which is the build user
+	// outside of it
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}}
+	// the server's supplementary groups would still count for the host's
+	// files bound into the sandbox, so they are cleared.  That takes root,
+	// and a server that isn't root can't give builds more groups than its
+	// own anyway.
+	if os.Geteuid() == 0 {
+		attr.GidMappingsEnableSetgroups = true
+		attr.Credential = &syscall.Credential{Uid: 0, Gid: 0, Groups: []uint32{}}
+	} else {
+		attr.Credential = &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: true}
+	}
+	return args, cleanup, nil
+}
+
+// setupSandbox runs inside the sandbox's namespaces.  It builds a read-only
+// view of the host on root, with only the writable directories bound into it,
+// and switches to it.  Since the command becomes PID 1 of its namespace,
+// every process it starts is killed when it exits.
+func setupSandbox(root, cwd string, binds []string) error {
+	runtime.LockOSThread()
+
+	// keep the mounts below from propagating back to the host
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+
+	err = syscall.Mount("/", root, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("binding root: %v", err)
+	}
+	err = remountReadOnly(root)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range sandboxScratch {
+		target := filepath.Join(root, dir)
+		if info, err := os.Stat(target); err != nil || !info.IsDir() {
+			continue
+		}
+		err = syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+		if err != nil {
+			return fmt.Errorf("mounting tmpfs on %s: %v", dir, err)
+		}
+	}
+
+	for _, dir := range binds {
+		target := filepath.Join(root, dir)
+		err = os.MkdirAll(target, 0755)
+		if err == nil {
+			err = syscall.Mount(dir, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+		}
+		if err != nil {
+			return fmt.Errorf("binding %s: %v", dir, err)
+		}
+	}
+
+	// a fresh /proc only shows the sandbox's own processes.  Some hosts don't
+	// allow it, in which case the read-only copy of the host's is kept.
+	syscall.Mount("proc", filepath.Join(root, "proc"), "proc",
+		syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+
+	oldRoot := filepath.Join(root, "tmp", ".oldroot")
+	err = os.MkdirAll(oldRoot, 0700)
+	if err != nil {
+		return err
+	}
+	err = syscall.PivotRoot(root, oldRoot)
+	if err != nil {
+		return fmt.Errorf("switching root: %v", err)
+	}
+	err = syscall.Chdir("/")
+	if err == nil {
+		err = syscall.Unmount("/tmp/.oldroot", syscall.MNT_DETACH)
+	}
+	if err != nil {
+		return fmt.Errorf("detaching old root: %v", err)
+	}
+	os.Remove("/tmp/.oldroot")
+
+	if cwd != "" {
+		return syscall.Chdir(cwd)
+	}
+	return nil
+}
+
+// remountReadOnly makes root and every mount below it read-only, keeping the
+// other flags of each mount as they are.
+func remountReadOnly(root string) error {
+	mounts, err := mountsBelow(root)
+	if err != nil {
+		return err
+	}
+
+	for _, mount := range mounts {
+		var stat syscall.Statfs_t
+		err = syscall.Statfs(mount, &stat)
+		if err == nil {
+			flags := uintptr(syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY) | mountFlags(stat.Flags)
+			err = syscall.Mount("", mount, "", flags, "")
+		}
+		if err != nil && mount == root {
+			return fmt.Errorf("remounting %s read-only: %v", mount, err)
+		}
+		// pseudo filesystems may refuse to be remounted, which is fine as
+		// long as they don't hold anything the build could write to
+		if err != nil && !isPseudoMount(root, mount) {
+			return fmt.Errorf("remounting %s read-only: %v", mount[len(root):], err)
+		}
+	}
+	return nil
+}
+
+func isPseudoMount(root, mount string) bool {
+	for _, dir := range []string{"/proc", "/sys", "/dev"} {
+		prefix := filepath.Join(root, dir)
+		if mount == prefix || strings.HasPrefix(mount, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// mountFlags converts the flags reported by statfs into the mount flags that
+// a remount has to keep.
+func mountFlags(statFlags int64) uintptr {
+	const (
+		ST_NOSUID     = 0x2
+		ST_NODEV      = 0x4
+		ST_NOEXEC     = 0x8
+		ST_NOATIME    = 0x400
+		ST_NODIRATIME = 0x800
+		ST_RELATIME   = 0x1000
+	)
+	pairs := [][2]int64{
+		{ST_NOSUID, syscall.MS_NOSUID},
+		{ST_NODEV, syscall.MS_NODEV},
+		{ST_NOEXEC, syscall.MS_NOEXEC},
+		{ST_NOATIME, syscall.MS_NOATIME},
+		{ST_NODIRATIME, syscall.MS_NODIRATIME},
+		{ST_RELATIME, syscall.MS_RELATIME},
+	}
+	var flags uintptr
+	for _, pair := range pairs {
+		if statFlags&pair[0] != 0 {
+			flags |= uintptr(pair[1])
+		}
+	}
+	return flags
+}
+
+// mountsBelow lists root and the mount points below it, parents first.
+func mountsBelow(root string) ([]string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mount := unescapeMount(fields[4])
+		if mount == root || strings.HasPrefix(mount, root+"/") {
+			mounts = append(mounts, mount)
+		}
+	}
+	sort.Strings(mounts)
+	return mounts, scanner.Err()
+}
+
+// unescapeMount decodes the octal escapes used for spaces and other special
+// characters in /proc/self/mountinfo.
+func unescapeMount(path string) string {
+	var result strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				result.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		result.WriteByte(path[i])
+	}
+	return result.String()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Schedule queues a job for a source and ref whenever its cron expression
+// matches.
+type Schedule struct {
+	ID     int
+	Source string
+	Ref    string
+	Cron   string
+	// Next is when the schedule will run next.  It is only filled in for
+	// listing.
+	Next time.Time `json:",omitempty"`
+}
+
+// JobArgs returns the arguments of the jobs that the schedule queues.
+func (schedule Schedule) JobArgs() map[string]string {
+	return map[string]string{
+		"source":   schedule.Source,
+		"git":      schedule.Ref,
+		"schedule": fmt.Sprintf("%d", schedule.ID),
+	}
+}
+
+// ScheduleStore keeps schedules in a bolt bucket.
+type ScheduleStore struct {
+	db   *bolt.DB
+	name string
+}
+
+func NewScheduleStore(db *bolt.DB, name string) (*ScheduleStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(name))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ScheduleStore{db: db, name: name}, nil
+}
+
+// Add stores a new schedule, giving it an ID.
+func (store *ScheduleStore) Add(schedule Schedule) (Schedule, error) {
+	cron, err := ParseCron(schedule.Cron)
+	if err != nil {
+		return schedule, err
+	}
+	if cron.Next(time.Now()).IsZero() {
+		return schedule, fmt.Errorf("cron expression '%s' never matches", schedule.Cron)
+	}
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(store.name))
+		id, _ := bucket.NextSequence()
+		schedule.ID = int(id)
+
+		buf, err := json.Marshal(schedule)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(itob(schedule.ID), buf)
+	})
+	return schedule, err
+}
+
+func (store *ScheduleStore) Remove(id int) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(store.name))
+		if bucket.Get(itob(id)) == nil {
+			return notFound("schedule %d does not exist", id)
+		}
+		return bucket.Delete(itob(id))
+	})
+}
+
+// All returns every schedule, in the order they were added.
+func (store *ScheduleStore) All() ([]Schedule, error) {
+	schedules := make([]Schedule, 0)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(store.name))
+		return bucket.ForEach(func(k, v []byte) error {
+			var schedule Schedule
+			err := json.Unmarshal(v, &schedule)
+			if err != nil {
+				return err
+			}
+			schedules = append(schedules, schedule)
+			return nil
+		})
+	})
+	return schedules, err
+}
+
+// scheduleWorker queues the jobs of every schedule that matches, once a
+// minute, until stop is closed.  Runs that were due while the server was down
+// are skipped rather than caught up on.
+func scheduleWorker(store *ScheduleStore, queue *JobQueue, stop <-chan struct{}) {
+	logger := log.New(os.Stdout, "scheduler: ", log.LstdFlags)
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+
+		schedules, err := store.All()
+		if err != nil {
+			logger.Printf("Error loading schedules: %v", err)
+			continue
+		}
+		for _, schedule := range schedules {
+			cron, err := ParseCron(schedule.Cron)
+			if err != nil || !cron.Matches(next) {
+				continue
+			}
+			// the configuration is checked as it is for other new jobs, so
+			// that a broken schedule is skipped rather than queued to fail
+			job := Job{Args: schedule.JobArgs()}
+			config, err := validateSource(job.Args)
+			if err == nil {
+				job.After, err = jobDependencies(nil, config, queue)
+			}
+			if err == nil {
+				job, err = queue.AddJob(job)
+			}
+			if err != nil {
+				logger.Printf("Error queueing schedule %d: %v", schedule.ID, err)
+			} else {
+				logger.Printf("Queued job #%d for schedule %d", job.Number, schedule.ID)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+)
+
+const secretKeySize = 32
+
+// SecretStore keeps named secrets in the database, encrypted with a key that
+// is stored outside of it.
+type SecretStore struct {
+	db   *bolt.DB
+	name string
+	aead cipher.AEAD
+}
+
+// LoadSecretKey reads the key used to encrypt secrets, generating a new one if
+// the file doesn't exist yet.
+func LoadSecretKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(key) != secretKeySize {
+			return nil, fmt.Errorf("secret key %s has the wrong size", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, secretKeySize)
+	if _, err = io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return key, ioutil.WriteFile(path, key, 0600)
+}
+
+func NewSecretStore(db *bolt.DB, name string, key []byte) (*SecretStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(name))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecretStore{db: db, name: name, aead: aead}, nil
+}
+
+func (store *SecretStore) Set(name, value string) error {
+	nonce := make([]byte, store.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	// the name is authenticated so that values can't be swapped between keys
+	sealed := store.aead.Seal(nonce, nonce, []byte(value), []byte(name))
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(store.name)).Put([]byte(name), sealed)
+	})
+}
+
+func (store *SecretStore) Remove(name string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(store.name))
+		if bucket.Get([]byte(name)) == nil {
+			return notFound("secret '%s' does not exist", name)
+		}
+		return bucket.Delete([]byte(name))
+	})
+}
+
+func (store *SecretStore) Names() ([]string, error) {
+	names := make([]string, 0)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(store.name)).ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// All decrypts every secret in the store.
+func (store *SecretStore) All() (map[string]string, error) {
+	secrets := make(map[string]string)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(store.name)).ForEach(func(k, v []byte) error {
+			value, err := store.open(string(k), v)
+			if err != nil {
+				return err
+			}
+			secrets[string(k)] = value
+			return nil
+		})
+	})
+	return secrets, err
+}
+
+func (store *SecretStore) open(name string, sealed []byte) (string, error) {
+	size := store.aead.NonceSize()
+	if len(sealed) < size {
+		return "", fmt.Errorf("secret '%s' is corrupt", name)
+	}
+	value, err := store.aead.Open(nil, sealed[:size], sealed[size:], []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("secret '%s' could not be decrypted", name)
+	}
+	return string(value), nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -16,8 +17,80 @@ import (
 	"github.com/boltdb/bolt"
 )
 
+// validateSource checks the deploy.yaml of the job's source at the requested
+// version, so that configuration mistakes are reported when the job is
+// created rather than after a full clone.
+func validateSource(args map[string]string) (config Config, err error) {
+	version, ok := args["git"]
+	if !ok {
+		return config, fmt.Errorf("VCS version must be provided")
+	}
+	contents, err := GitShowFile(args["source"], version, "deploy.yaml")
+	if err != nil {
+		return config, fmt.Errorf("could not read deploy.yaml at %s: %v", version, err)
+	}
+	return ParseConfig(contents, ValidationBuild)
+}
+
+// jobDependencies returns the jobs that a new job has to wait for: the given
+// ones, and the upstream job of each source in the configuration's after
+// section.
+func jobDependencies(after []int, config Config, queue *JobQueue) ([]int, error) {
+	for _, number := range after {
+		if !queue.Exists(number) {
+			return nil, notFound("job #%d does not exist", number)
+		}
+	}
+	for _, source := range config.After {
+		job, found, err := queue.UpstreamJob(source)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("'%s' has never been deployed successfully", source)
+		}
+		after = append(after, job.Number)
+	}
+	return after, nil
+}
+
 func respondDeploy(args map[string]string, queue *JobQueue) (response string, err error) {
-	job, err := queue.AddJob(args)
+	template := Job{Args: args}
+	if name, ok := args["priority"]; ok {
+		template.Priority, err = ParsePriority(name)
+		if err != nil {
+			return
+		}
+		delete(args, "priority")
+	}
+	var after []int
+	if list, ok := args["after"]; ok {
+		for _, field := range strings.Split(list, ",") {
+			var number int
+			number, err = strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(field), "#"))
+			if err != nil {
+				return response, fmt.Errorf("invalid job '%s'", field)
+			}
+			after = append(after, number)
+		}
+		delete(args, "after")
+	}
+	template.Environment = args["env"]
+	delete(args, "env")
+
+	config, err := validateSource(args)
+	if err != nil {
+		return
+	}
+	if _, err = config.ForEnvironment(template.Environment); err != nil {
+		return
+	}
+	template.After, err = jobDependencies(after, config, queue)
+	if err != nil {
+		return
+	}
+
+	job, err := queue.AddJob(template)
 	if err != nil {
 		return
 	}
@@ -35,21 +108,34 @@ func respondDeploy(args map[string]string, queue *JobQueue) (response string, er
 
 func respondRestart(args map[string]string, db *bolt.DB, queue *JobQueue) (response string, err error) {
 	jobNumber, err := strconv.Atoi(args["job"])
+	if err != nil {
+		return
+	}
 	var job Job
 	err = db.View(func(tx *bolt.Tx) error {
-		jobs := tx.Bucket([]byte("jobs"))
-		rawJob := jobs.Get(itob(jobNumber))
-		err := json.Unmarshal(rawJob, &job)
-		if err != nil {
-			return err
-		}
-		return nil
+		var err error
+		job, err = getJob(tx.Bucket([]byte("jobs")), jobNumber)
+		return err
 	})
 	if err != nil {
 		return
 	}
 
-	job, err = queue.AddJob(job.Args)
+	config, err := validateSource(job.Args)
+	if err != nil {
+		return
+	}
+	if _, err = config.ForEnvironment(job.Environment); err != nil {
+		return
+	}
+	// dependencies given on the command line have already been met, or the
+	// job wouldn't have run
+	job.After, err = jobDependencies(nil, config, queue)
+	if err != nil {
+		return
+	}
+
+	job, err = queue.AddJob(job)
 	if err != nil {
 		return
 	}
@@ -77,8 +163,7 @@ func respondStatus(args map[string]string, db *bolt.DB) (response string, err er
 				return err
 			}
 
-			rawJob := jobs.Get(itob(jobNumber))
-			err = json.Unmarshal(rawJob, &job)
+			job, err = getJob(jobs, jobNumber)
 			if err != nil {
 				return err
 			}
@@ -87,6 +172,7 @@ func respondStatus(args map[string]string, db *bolt.DB) (response string, err er
 		} else {
 			cursor := jobs.Cursor()
 			for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+				job = Job{}
 				err = json.Unmarshal(v, &job)
 				if err != nil {
 					return err
@@ -116,24 +202,42 @@ func respondLogs(args map[string]string, db *bolt.DB) (response string, err erro
 	if err != nil {
 		return
 	}
+	// a client following the logs only asks for the lines it hasn't seen
+	from := 0
+	if args["from"] != "" {
+		from, err = strconv.Atoi(args["from"])
+		if err != nil {
+			return
+		}
+	}
 
 	var job Job
 	logs := make([]string, 0)
 
 	err = db.View(func(tx *bolt.Tx) error {
-		jobs := tx.Bucket([]byte("jobs"))
-		rawJob := jobs.Get(itob(jobNumber))
-		err := json.Unmarshal(rawJob, &job)
+		var err error
+		job, err = getJob(tx.Bucket([]byte("jobs")), jobNumber)
 		if err != nil {
 			return err
 		}
 
+		// jobs that haven't started have no logs yet
 		lb := tx.Bucket([]byte("logs"))
+		if lb == nil {
+			return nil
+		}
 		jobLogs := lb.Bucket([]byte(fmt.Sprintf("job-%d", jobNumber)))
+		if jobLogs == nil {
+			return nil
+		}
 		cursor := jobLogs.Cursor()
 
+		line := 0
 		for k, msg := cursor.First(); k != nil; k, msg = cursor.Next() {
-			logs = append(logs, string(msg))
+			if line >= from {
+				logs = append(logs, string(msg))
+			}
+			line++
 		}
 
 		return nil
@@ -154,11 +258,211 @@ func respondLogs(args map[string]string, db *bolt.DB) (response string, err erro
 	return
 }
 
-func jobWorker(id int, queue *JobQueue, db *bolt.DB) {
+func respondSecrets(command string, args map[string]string, secrets *SecretStore) (response string, err error) {
+	switch command {
+	case "secret-set":
+		err = secrets.Set(args["name"], args["value"])
+	case "secret-rm":
+		err = secrets.Remove(args["name"])
+	}
+	if err != nil {
+		return
+	}
+
+	names, err := secrets.Names()
+	if err != nil {
+		return
+	}
+
+	result := SecretsResponse{
+		Names: names,
+	}
+	buf, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	response = string(buf)
+	return
+}
+
+func respondArtifacts(command string, args map[string]string) (response string, err error) {
+	jobNumber, err := strconv.Atoi(args["job"])
+	if err != nil {
+		return
+	}
+
+	var result interface{}
+	if command == "artifacts-get" {
+		var archive []byte
+		archive, err = GetArtifacts(jobNumber, args["path"])
+		result = ArtifactResponse{Archive: archive}
+	} else {
+		var files []ArchiveFile
+		files, err = ListArtifacts(jobNumber)
+		result = ArtifactsResponse{Files: files}
+	}
+	if err != nil {
+		return
+	}
+
+	buf, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	response = string(buf)
+	return
+}
+
+func respondSchedules(command string, args map[string]string, schedules *ScheduleStore) (response string, err error) {
+	switch command {
+	case "schedule-add":
+		_, err = validateSource(args)
+		if err != nil {
+			return
+		}
+		_, err = schedules.Add(Schedule{
+			Source: args["source"],
+			Ref:    args["git"],
+			Cron:   args["cron"],
+		})
+	case "schedule-rm":
+		var id int
+		id, err = strconv.Atoi(args["id"])
+		if err == nil {
+			err = schedules.Remove(id)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	all, err := schedules.All()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for i := range all {
+		if cron, err := ParseCron(all[i].Cron); err == nil {
+			all[i].Next = cron.Next(now)
+		}
+	}
+
+	result := SchedulesResponse{
+		Schedules: all,
+	}
+	buf, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	response = string(buf)
+	return
+}
+
+func respondQueue(command string, args map[string]string, queue *JobQueue) (response string, err error) {
+	switch command {
+	case "queue-move":
+		var number, position int
+		number, err = strconv.Atoi(args["job"])
+		if err == nil {
+			position, err = strconv.Atoi(args["position"])
+		}
+		if err == nil {
+			err = queue.Move(number, position)
+		}
+	case "queue-rm":
+		var number int
+		number, err = strconv.Atoi(args["job"])
+		if err == nil {
+			err = queue.Cancel(number)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	pending, err := queue.Pending()
+	if err != nil {
+		return
+	}
+
+	result := StatusResponse{
+		Statuses: pending,
+	}
+	buf, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	response = string(buf)
+	return
+}
+
+func respondDeployments(queue *JobQueue) (response string, err error) {
+	deployments, err := queue.Deployments()
+	if err != nil {
+		return
+	}
+	buf, err := json.Marshal(DeploymentsResponse{Deployments: deployments})
+	if err != nil {
+		return
+	}
+	response = string(buf)
+	return
+}
+
+func respondApproval(command string, args map[string]string, queue *JobQueue) (response string, err error) {
+	number, err := strconv.Atoi(args["job"])
+	if err != nil {
+		return
+	}
+
+	var job Job
+	if command == "approve" {
+		job, err = queue.Approve(number)
+	} else {
+		job, err = queue.Reject(number)
+		if err == nil {
+			RemoveWorkspace(number)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	buf, err := json.Marshal(DeployResponse{Job: job})
+	if err != nil {
+		return
+	}
+	response = string(buf)
+	return
+}
+
+// retentionWorker removes expired artifacts every hour until stop is closed.
+func retentionWorker(stop <-chan struct{}) {
+	logger := log.New(os.Stdout, "retention: ", log.LstdFlags)
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		err := RemoveExpiredArtifacts(logger)
+		if err != nil {
+			logger.Printf("Error removing expired artifacts: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func jobWorker(id int, queue *JobQueue, db *bolt.DB, secrets *SecretStore) {
 	logger := log.New(os.Stdout, fmt.Sprintf("worker%d: ", id), log.LstdFlags)
 	logger.Println("Worker started.")
-	for job := range queue.Output {
-		func() {
+	for {
+		job, ok := queue.Next()
+		if !ok {
+			break
+		}
+		status := func() JobStatus {
 			logger.Printf("Starting job #%d", job.Number)
 
 			writer, err := NewDbWriter(db, 500*time.Millisecond, "logs",
@@ -168,16 +472,28 @@ func jobWorker(id int, queue *JobQueue, db *bolt.DB) {
 			}
 			defer writer.Close()
 
-			jobLogger := log.New(writer, "", log.LstdFlags)
-			err = RunJob(job, jobLogger)
+			values, err := secrets.All()
+			if err != nil {
+				logger.Printf("Error loading secrets: %v", err)
+			}
+
+			jobLogger := log.New(NewMaskingWriter(writer, values), "", log.LstdFlags)
+			err = RunJob(&job, values, jobLogger)
 			if err == nil {
 				logger.Printf("Job #%d succeeeded", job.Number)
-				queue.FinishJob(job, true)
+				if len(job.Triggers) > 0 {
+					job.Children = queueTriggers(job, queue, jobLogger)
+				}
+			} else if err == errAwaitingApproval {
+				logger.Printf("Job #%d is waiting for approval", job.Number)
 			} else {
 				logger.Printf("Job #%d failed: %v", job.Number, err)
-				queue.FinishJob(job, false)
 			}
+			return StatusForError(err)
 		}()
+		// the logs are all stored by now, so that a client waiting for the
+		// job sees all of them once it finishes
+		queue.FinishJob(job, status)
 	}
 	logger.Println("Worker stopped.")
 }
@@ -202,7 +518,7 @@ func acceptLoop(listener net.Listener, wg *sync.WaitGroup) <-chan net.Conn {
 	return output
 }
 
-func executeCommand(command ClientCommand, queue *JobQueue, db *bolt.DB) (response string, err error) {
+func executeCommand(command ClientCommand, queue *JobQueue, db *bolt.DB, secrets *SecretStore, schedules *ScheduleStore) (response string, err error) {
 	switch command.Command {
 	case "deploy":
 		response, err = respondDeploy(command.Args, queue)
@@ -212,6 +528,18 @@ func executeCommand(command ClientCommand, queue *JobQueue, db *bolt.DB) (respon
 		response, err = respondLogs(command.Args, db)
 	case "status":
 		response, err = respondStatus(command.Args, db)
+	case "secret-set", "secret-list", "secret-rm":
+		response, err = respondSecrets(command.Command, command.Args, secrets)
+	case "artifacts", "artifacts-get":
+		response, err = respondArtifacts(command.Command, command.Args)
+	case "queue", "queue-move", "queue-rm":
+		response, err = respondQueue(command.Command, command.Args, queue)
+	case "deployments":
+		response, err = respondDeployments(queue)
+	case "approve", "reject":
+		response, err = respondApproval(command.Command, command.Args, queue)
+	case "schedule-add", "schedule-list", "schedule-rm":
+		response, err = respondSchedules(command.Command, command.Args, schedules)
 	case "shutdown":
 		response = ""
 		err = fmt.Errorf("Shutdown")
@@ -221,11 +549,54 @@ func executeCommand(command ClientCommand, queue *JobQueue, db *bolt.DB) (respon
 	return
 }
 
+// NotFoundError reports that a job, or anything else a command asked for,
+// doesn't exist.
+type NotFoundError struct {
+	Message string
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &NotFoundError{Message: fmt.Sprintf(format, args...)}
+}
+
+func (err *NotFoundError) Error() string {
+	return err.Message
+}
+
+func errorResponse(err error) string {
+	var notFoundErr *NotFoundError
+	buf, _ := json.Marshal(ErrorResponse{
+		Error:    err.Error(),
+		NotFound: errors.As(err, &notFoundErr),
+	})
+	return string(buf)
+}
+
 func RunServer(args []string, options map[string]string) int {
 	sigs := make(chan os.Signal, 8)
 	defer close(sigs)
 	signal.Notify(sigs, os.Interrupt, os.Kill)
 
+	// catch mistakes in the limits before any job runs into them
+	_, err := ServerLimits()
+	if err != nil {
+		log.Printf("Error loading resource limits: %v", err)
+		return 1
+	}
+	if _, err = ParseSize(CACHE_SIZE); err != nil {
+		log.Printf("Error loading cache size: %v", err)
+		return 1
+	}
+	coalesce, err := strconv.ParseBool(COALESCE)
+	if err != nil {
+		log.Printf("Error loading coalesce setting: invalid value '%s'", COALESCE)
+		return 1
+	}
+	if _, err = time.ParseDuration(RETENTION); RETENTION != "" && err != nil {
+		log.Printf("Error loading retention: invalid duration '%s'", RETENTION)
+		return 1
+	}
+
 	listen, err := net.Listen("unix", SOCKET_PATH)
 	if err != nil {
 		log.Printf("Error starting server: %v", err)
@@ -247,21 +618,55 @@ func RunServer(args []string, options map[string]string) int {
 	}
 	defer db.Close()
 
+	key, err := LoadSecretKey(SECRET_KEY_PATH)
+	if err != nil {
+		log.Printf("Error loading secret key: %v", err)
+		return 1
+	}
+
+	secrets, err := NewSecretStore(db, "secrets", key)
+	if err != nil {
+		log.Printf("Error opening secret store: %v", err)
+		return 1
+	}
+
 	queue, err := NewJobQueue(db, "jobs")
 	if err != nil {
 		log.Printf("Error creating job queue: %v", err)
 		return 1
 	}
+	queue.Coalesce = coalesce
+
+	schedules, err := NewScheduleStore(db, "schedules")
+	if err != nil {
+		log.Printf("Error opening schedules: %v", err)
+		return 1
+	}
 
 	var wg sync.WaitGroup
 	for i := 1; i <= 1; i++ {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			jobWorker(i, queue, db)
+			jobWorker(i, queue, db, secrets)
 		}(i)
 	}
 
+	stopWorkers := make(chan struct{})
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		retentionWorker(stopWorkers)
+	}()
+	go func() {
+		defer wg.Done()
+		approvalWorker(queue, stopWorkers)
+	}()
+	go func() {
+		defer wg.Done()
+		scheduleWorker(schedules, queue, stopWorkers)
+	}()
+
 	conns := acceptLoop(listen, &wg)
 
 	running := true
@@ -286,15 +691,14 @@ func RunServer(args []string, options map[string]string) int {
 			continue
 		}
 
-		response, err := executeCommand(command, queue, db)
+		response, err := executeCommand(command, queue, db, secrets, schedules)
 		if err != nil {
 			if err.Error() == "Shutdown" {
 				log.Println("Shutdown command received")
 				running = false
-			} else if strings.HasPrefix(err.Error(), "Unknown command") {
-				log.Println(err.Error())
 			} else {
-				panic(err)
+				log.Printf("Error running %s command: %v", command.Command, err)
+				response = errorResponse(err)
 			}
 		}
 
@@ -304,6 +708,7 @@ func RunServer(args []string, options map[string]string) int {
 	}
 	listen.Close()
 
+	close(stopWorkers)
 	queue.Close()
 	wg.Wait()
 
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kr/text"
+)
+
+// Step is a single command in one of the command sections of the
+// configuration.  A step can be written as a plain string, which is used as
+// its Run command.  A step with Parallel steps instead of a command is a
+// group whose steps run at the same time.
+type Step struct {
+	Name            string
+	Run             string
+	Dir             string
+	Env             EnvList
+	Shell           string
+	Timeout         Duration
+	ContinueOnError bool `yaml:"continue_on_error"`
+	Privileged      bool
+	Retry           `yaml:",inline"`
+	Parallel        []Step
+}
+
+// errStepCancelled is the error of a step that was stopped because another
+// step running alongside it failed.
+var errStepCancelled = errors.New("cancelled after a parallel step failed")
+
+func (step *Step) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var command string
+	if err := unmarshal(&command); err == nil {
+		*step = Step{Run: command}
+		return nil
+	}
+
+	// a distinct type keeps unmarshal from calling this method again
+	type plainStep Step
+	return unmarshal((*plainStep)(step))
+}
+
+// Label names the step in logs and job results.  Unnamed steps are named
+// after their position in their section.
+func (step Step) Label(phase string, index int) string {
+	if step.Name != "" {
+		return step.Name
+	}
+	return fmt.Sprintf("%s step %d", phase, index+1)
+}
+
+// childLabel names the child'th step of the parallel group at index, like
+// Label.
+func (step Step) childLabel(phase string, index, child int) string {
+	if step.Name != "" {
+		return step.Name
+	}
+	return fmt.Sprintf("%s step %d.%d", phase, index+1, child+1)
+}
+
+// eachStep calls fn with the step at index and, if it is a parallel group,
+// each of the steps in the group, along with the path of each step in the
+// configuration.
+func eachStep(phase string, index int, step Step, fn func(label, path string, step Step)) {
+	path := fmt.Sprintf("%s.%d", phase, index)
+	fn(step.Label(phase, index), path, step)
+	for j, child := range step.Parallel {
+		fn(child.childLabel(phase, index, j), fmt.Sprintf("%s.parallel.%d", path, j), child)
+	}
+}
+
+// Execute runs the step's command in cwd, or in the step's own directory if
+// it has one.  Privileged steps run as the server's own user rather than the
+// runner's.  Cancelling ctx stops the command.  Unless the runner streams the
+// output elsewhere, it is logged once the command finishes.
+func (step Step) Execute(ctx context.Context, cwd string, env []string, runner Runner, logger *log.Logger) error {
+	dir := cwd
+	if step.Dir != "" {
+		dir = step.Dir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(cwd, dir)
+		}
+	}
+
+	env = step.Env.Apply(env)
+
+	shell := SHELL
+	if step.Shell != "" {
+		shell = step.Shell
+	}
+
+	stepCtx := ctx
+	timeout := time.Duration(step.Timeout)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		stepCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if step.Privileged {
+		runner = runner.Privileged()
+	}
+	output, err := runner.Run(stepCtx, dir, env, shell, "-c", step.Run)
+	if trimmed := strings.TrimSpace(output); len(trimmed) > 0 && runner.Output == nil {
+		logger.Println(text.Indent(trimmed, "    "))
+	}
+	if ctx.Err() != nil {
+		err = errStepCancelled
+	} else if stepCtx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+	return err
+}
+
+// runStep runs the index'th step of a section and records the result on the
+// job.
+func (d *deployment) runStep(cwd, phase string, index int, steps []Step, env []string) error {
+	step := steps[index]
+	if len(step.Parallel) > 0 {
+		return d.runParallel(cwd, phase, index, steps, env)
+	}
+	if step.Name != "" {
+		d.logger.Printf("Running %s step %d/%d (%s): %s",
+			phase, index+1, len(steps), step.Name, step.Run)
+	} else {
+		d.logger.Printf("Running %s step %d/%d: %s",
+			phase, index+1, len(steps), step.Run)
+	}
+
+	runner := d.stepRunner(phase)
+	if d.local != nil {
+		// there's no job log to keep tidy, so output is shown as it comes
+		output := NewLineWriter(d.logger)
+		defer output.Flush()
+		runner.Output = output
+	}
+
+	started := time.Now()
+	attempts, err := step.Retry.Do(context.Background(), d.logger, func() error {
+		return step.Execute(context.Background(), cwd, env, runner, d.logger)
+	})
+	d.job.RecordResult(StepResult{
+		Phase:    phase,
+		Name:     step.Label(phase, index),
+		Attempts: attempts,
+		Cell:     d.cell,
+	}, started, err)
+	return err
+}
+
+// stepRunner returns the runner for the steps of a phase.  Only build steps
+// are sandboxed and limited, since the later phases exist to change things
+// outside of the build directory.
+func (d *deployment) stepRunner(phase string) Runner {
+	runner := d.runner
+	if phase == "build" {
+		runner.Sandbox = d.sandbox
+		runner.Limits = d.limits
+		runner.Workspace = []string{d.build.Source, d.build.Build}
+	}
+	return runner
+}
+
+// runParallel runs the steps of the parallel group at index all at once,
+// recording each of their results.  Their output is logged as it is written,
+// with each line prefixed by the name of its step.  The first step to fail
+// cancels the others, unless it is marked continue_on_error.
+func (d *deployment) runParallel(cwd, phase string, index int, steps []Step, env []string) error {
+	group := steps[index]
+	if group.Name != "" {
+		d.logger.Printf("Running %s step %d/%d (%s): %d steps in parallel",
+			phase, index+1, len(steps), group.Name, len(group.Parallel))
+	} else {
+		d.logger.Printf("Running %s step %d/%d: %d steps in parallel",
+			phase, index+1, len(steps), len(group.Parallel))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mutex sync.Mutex
+	var failure error
+	var wg sync.WaitGroup
+	for j, step := range group.Parallel {
+		label := step.childLabel(phase, index, j)
+		logger := log.New(d.logger.Writer(), "["+label+"] ", d.logger.Flags()|log.Lmsgprefix)
+		output := NewLineWriter(logger)
+		runner := d.stepRunner(phase)
+		runner.Output = output
+
+		wg.Add(1)
+		go func(step Step) {
+			defer wg.Done()
+			logger.Printf("Running: %s", step.Run)
+			started := time.Now()
+			attempts, err := step.Retry.Do(ctx, logger, func() error {
+				return step.Execute(ctx, cwd, env, runner, logger)
+			})
+			output.Flush()
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			d.job.RecordResult(StepResult{
+				Phase:    phase,
+				Name:     label,
+				Attempts: attempts,
+				Cell:     d.cell,
+			}, started, err)
+			switch {
+			case err == nil:
+			case err == errStepCancelled:
+				logger.Println("Cancelled")
+			case step.ContinueOnError:
+				logger.Printf("Step failed, continuing: %v", err)
+			default:
+				logger.Printf("Error while running command: %v", err)
+				if failure == nil {
+					failure = err
+					cancel()
+				}
+			}
+		}(step)
+	}
+	wg.Wait()
+	return failure
+}
+
+// runStepList runs a section of steps in order, stopping at the first one
+// that fails unless it is marked continue_on_error.  The label of the failed
+// step is returned along with the error.
+func (d *deployment) runStepList(cwd, phase string, steps []Step, env []string) (string, error) {
+	for i, step := range steps {
+		err := d.runStep(cwd, phase, i, steps, env)
+		if err == nil {
+			continue
+		}
+		if step.ContinueOnError {
+			d.logger.Printf("Step failed, continuing: %v", err)
+			continue
+		}
+		d.logger.Printf("Error while running command: %v", err)
+		return step.Label(phase, i), err
+	}
+	return "", nil
+}
+
+// appendEnv returns a copy of env with the given variables added, so that
+// steps can't modify each other's environments.
+func appendEnv(env []string, vars ...string) []string {
+	result := make([]string, 0, len(env)+len(vars))
+	result = append(result, env...)
+	return append(result, vars...)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+)
+
+// Trigger is another project to deploy after a successful deploy of this
+// one, at the head of the given ref.
+type Trigger struct {
+	Source string
+	Ref    string
+}
+
+// JobArgs returns the arguments of the job that the trigger queues, building
+// the given commit of its ref.
+func (trigger Trigger) JobArgs(commit string) map[string]string {
+	return map[string]string{
+		"source": trigger.Source,
+		"git":    commit,
+		"ref":    trigger.Ref,
+	}
+}
+
+// queueTriggers queues a child job for each of the triggers of a job that has
+// succeeded, returning their numbers.  A trigger for a project that is
+// already part of the chain of jobs that led to this one is skipped, so that
+// projects which trigger each other don't deploy forever.  Problems are
+// logged, but don't change the outcome of the job.
+func queueTriggers(job Job, queue *JobQueue, logger *log.Logger) (children []int) {
+	ancestors, err := queue.Ancestors(job)
+	if err != nil {
+		logger.Printf("Error looking up parent jobs: %v", err)
+		return
+	}
+	chain := map[string]bool{job.Args["source"]: true}
+	for _, ancestor := range ancestors {
+		chain[ancestor.Args["source"]] = true
+	}
+
+	for _, trigger := range job.Triggers {
+		if chain[trigger.Source] {
+			logger.Printf("Not triggering '%s', which led to this job", trigger.Source)
+			continue
+		}
+
+		// the ref is resolved now, so that the child builds the commit the
+		// ref pointed to when it was triggered, and records it as deployed
+		commit, err := GitResolve(trigger.Source, trigger.Ref)
+		if err != nil {
+			logger.Printf("Error triggering '%s' at %s: %v", trigger.Source, trigger.Ref, err)
+			continue
+		}
+		template := Job{
+			Args:     trigger.JobArgs(commit),
+			Priority: job.Priority,
+			Parent:   job.Number,
+		}
+		config, err := validateSource(template.Args)
+		if err == nil {
+			template.After, err = jobDependencies(nil, config, queue)
+		}
+		if err == nil {
+			template, err = queue.AddJob(template)
+		}
+		if err != nil {
+			logger.Printf("Error triggering '%s' at %s: %v", trigger.Source, trigger.Ref, err)
+			continue
+		}
+		logger.Printf("Triggered job #%d for '%s' at %s (%.8s)", template.Number, trigger.Source, trigger.Ref, commit)
+		children = append(children, template.Number)
+	}
+	return
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/kr/text"
 )
@@ -43,3 +45,27 @@ func GitSourceVersion(sourcePath, targetParent, version string, logger *log.Logg
 
 	return
 }
+
+// GitShowFile reads a file from a git repository at the given version,
+// without checking it out.
+func GitShowFile(sourcePath, version, name string) ([]byte, error) {
+	cmd := exec.Command("git", "show", version+":"+name)
+	cmd.Dir = sourcePath
+	output, err := cmd.Output()
+	if ee, ok := err.(*exec.ExitError); ok {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(string(ee.Stderr)))
+	}
+	return output, err
+}
+
+// GitResolve returns the hash of the commit that a ref of a git repository
+// currently points to.
+func GitResolve(sourcePath, ref string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	cmd.Dir = sourcePath
+	output, err := cmd.Output()
+	if _, ok := err.(*exec.ExitError); ok {
+		return "", fmt.Errorf("'%s' is not a commit", ref)
+	}
+	return strings.TrimSpace(string(output)), err
+}